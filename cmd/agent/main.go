@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
+	"crypto/rsa"
 	"github.com/fireflg/ago-musthave-metrics-tpl/internal/agent"
+	"github.com/fireflg/ago-musthave-metrics-tpl/internal/encryption"
 	"go.uber.org/zap"
 	"log"
 	"os"
@@ -24,28 +26,55 @@ func main() {
 		logger.Fatal("Failed to load config", zap.Error(err))
 	}
 
-	reporter := agent.NewReporter(cfg.ServerURL)
-	provider := agent.Provider{}
-	storage := agent.Metrics{}
+	var publicKey *rsa.PublicKey
+	if cfg.CryptoKey != "" {
+		if publicKey, err = encryption.LoadPublicKey(cfg.CryptoKey); err != nil {
+			logger.Fatal("Failed to load crypto key", zap.Error(err))
+		}
+	}
+
+	var reporter agent.MetricsReporter = agent.NewReporter(cfg.ServerURL, cfg.Key, cfg.AgentID, publicKey)
+	if cfg.Transport == "grpc" {
+		grpcReporter, err := agent.NewGRPCReporter(cfg.GRPCAddress, cfg.Key, cfg.AgentID)
+		if err != nil {
+			logger.Fatal("Failed to create gRPC reporter", zap.Error(err))
+		}
+		defer grpcReporter.Close()
+		reporter = grpcReporter
+	}
+	collectors, err := agent.NewCollectors(cfg.Collectors)
+	if err != nil {
+		logger.Fatal("Failed to initialize collectors", zap.Error(err))
+	}
+	storage := agent.NewMetrics()
 
-	agent := agent.NewAgent(cfg, &provider, reporter, logger, storage)
+	agent := agent.NewAgent(cfg, collectors, reporter, logger, storage)
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
+	done := make(chan error, 1)
 	go func() {
-		if err := agent.Start(ctx); err != nil {
-			logger.Error("Agent failed", zap.Error(err))
-		}
+		done <- agent.Run(context.Background())
 	}()
 
-	stop := make(chan os.Signal, 1)
-	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
-	<-stop
+	select {
+	case <-ctx.Done():
+	case err := <-done:
+		if err != nil {
+			logger.Error("Agent failed", zap.Error(err))
+		}
+		return
+	}
 
 	logger.Info("Starting graceful shutdown...")
-	cancel()
 
-	time.Sleep(1 * time.Second)
+	// Run bounds the final reports by ShutdownTimeout, the extra second covers the bookkeeping.
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.ShutdownTimeout+1)*time.Second)
+	defer cancel()
+
+	if err := agent.Stop(shutdownCtx); err != nil {
+		logger.Error("Agent shutdown timed out", zap.Error(err))
+	}
 	logger.Info("Shutdown complete")
 }
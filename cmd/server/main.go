@@ -2,11 +2,20 @@ package main
 
 import (
 	"context"
+	"crypto/rsa"
+	"github.com/fireflg/ago-musthave-metrics-tpl/internal/alerting"
+	"github.com/fireflg/ago-musthave-metrics-tpl/internal/audit"
 	"github.com/fireflg/ago-musthave-metrics-tpl/internal/config/server"
+	"github.com/fireflg/ago-musthave-metrics-tpl/internal/encryption"
+	"github.com/fireflg/ago-musthave-metrics-tpl/internal/grpcserver"
 	"github.com/fireflg/ago-musthave-metrics-tpl/internal/handler"
+	pb "github.com/fireflg/ago-musthave-metrics-tpl/internal/proto"
 	"github.com/fireflg/ago-musthave-metrics-tpl/internal/repository"
+	"github.com/fireflg/ago-musthave-metrics-tpl/internal/repository/db"
 	"github.com/fireflg/ago-musthave-metrics-tpl/internal/service"
 	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -27,15 +36,22 @@ func main() {
 		logger.Fatal("Failed to load config", zap.Error(err))
 	}
 
+	if cfg.MigrateOnly || cfg.MigrateDown > 0 {
+		if cfg.DatabaseDSN == "" {
+			logger.Fatal("Migrations require DATABASE_DSN")
+		}
+		if err := db.RunMigrations(cfg.DatabaseDSN, cfg.MigrateDown); err != nil {
+			logger.Fatal("Failed to run migrations", zap.Error(err))
+		}
+		logger.Info("Migrations complete")
+		return
+	}
+
 	repo, err := repository.NewRepository(*cfg)
 	if err != nil {
 		logger.Fatal("Failed to initialize repository", zap.Error(err))
 	}
 
-	metricsService := service.NewMetricsService(repo)
-	metricsHandler := handler.NewMetricsHandler(metricsService, logger.Sugar())
-	r := metricsHandler.ServerRouter()
-
 	ctx, stop := signal.NotifyContext(
 		context.Background(),
 		os.Interrupt,
@@ -43,6 +59,54 @@ func main() {
 	)
 	defer stop()
 
+	metricsService := service.NewMetricsService(repo)
+
+	var auditFile *audit.FileSink
+	if cfg.AuditFile != "" {
+		if auditFile, err = audit.NewFileSink(cfg.AuditFile, sugar); err != nil {
+			logger.Fatal("Failed to open audit file", zap.Error(err))
+		}
+		metricsService.Attach(auditFile)
+	}
+
+	var auditHTTP *audit.HTTPSink
+	if cfg.AuditURL != "" {
+		auditHTTP = audit.NewHTTPSink(cfg.AuditURL, sugar)
+		metricsService.Attach(auditHTTP)
+	}
+
+	var staleChecker *service.StaleChecker
+	if cfg.StaleTTL > 0 {
+		ttl := time.Duration(cfg.StaleTTL) * time.Second
+		staleChecker = service.NewStaleChecker(metricsService, ttl, cfg.StaleWebhook, sugar)
+		go staleChecker.Run(ctx, max(ttl/2, time.Second))
+	}
+
+	var alertEngine *alerting.Engine
+	if cfg.AlertRules != "" {
+		rules, err := alerting.LoadRules(cfg.AlertRules)
+		if err != nil {
+			logger.Fatal("Failed to load alerting rules", zap.Error(err))
+		}
+		alertEngine = alerting.NewEngine(repo, rules, cfg.AlertWebhook, sugar)
+		go alertEngine.Run(ctx, time.Duration(cfg.AlertInterval)*time.Second)
+	}
+
+	var cryptoKey *rsa.PrivateKey
+	if cfg.CryptoKey != "" {
+		if cryptoKey, err = encryption.LoadPrivateKey(cfg.CryptoKey); err != nil {
+			logger.Fatal("Failed to load crypto key", zap.Error(err))
+		}
+	}
+
+	var trusted *net.IPNet
+	if cfg.TrustedSubnet != "" {
+		_, trusted, _ = net.ParseCIDR(cfg.TrustedSubnet)
+	}
+
+	metricsHandler := handler.NewMetricsHandler(metricsService, logger.Sugar(), cfg.Key, staleChecker, alertEngine, cryptoKey, trusted)
+	r := metricsHandler.ServerRouter()
+
 	srv := &http.Server{
 		Addr:        cfg.RunAddr,
 		Handler:     r,
@@ -61,10 +125,35 @@ func main() {
 		}
 	}()
 
+	var grpcServer *grpc.Server
+	if cfg.GRPCAddr != "" {
+		listener, err := net.Listen("tcp", cfg.GRPCAddr)
+		if err != nil {
+			logger.Fatal("Failed to listen for gRPC", zap.String("addr", cfg.GRPCAddr), zap.Error(err))
+		}
+		grpcServer = grpc.NewServer(grpc.ChainUnaryInterceptor(
+			grpcserver.WithLogging(sugar),
+			grpcserver.WithTrustedSubnet(trusted),
+			grpcserver.WithHash(cfg.Key),
+		))
+		pb.RegisterMetricsServer(grpcServer, grpcserver.NewServer(metricsService))
+
+		go func() {
+			sugar.Infof("Starting gRPC server on %s", cfg.GRPCAddr)
+			if err := grpcServer.Serve(listener); err != nil {
+				logger.Fatal("gRPC server failed", zap.Error(err))
+			}
+		}()
+	}
+
 	<-ctx.Done()
 
 	logger.Info("Starting graceful shutdown...")
 
+	if grpcServer != nil {
+		grpcServer.GracefulStop()
+	}
+
 	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
@@ -72,5 +161,20 @@ func main() {
 		logger.Error("server shutdown failed", zap.Error(err))
 	}
 
+	if err := repo.Close(shutdownCtx); err != nil {
+		logger.Error("Failed to close repository", zap.Error(err))
+	}
+
+	if auditHTTP != nil {
+		if err := auditHTTP.Close(shutdownCtx); err != nil {
+			logger.Error("Failed to flush audit events", zap.Error(err))
+		}
+	}
+	if auditFile != nil {
+		if err := auditFile.Close(); err != nil {
+			logger.Error("Failed to close audit file", zap.Error(err))
+		}
+	}
+
 	logger.Info("Shutdown complete")
 }
@@ -2,78 +2,270 @@ package agent
 
 import (
 	"context"
-	"runtime"
+	"errors"
+	"sync"
 	"time"
 
+	models "github.com/fireflg/ago-musthave-metrics-tpl/internal/model"
 	"go.uber.org/zap"
 )
 
-type MetricsProvider interface {
-	Poll() runtime.MemStats
-}
-
 type MetricsReporter interface {
-	Report(ctx context.Context, metrics Metrics) error
+	Report(ctx context.Context, metrics []models.Metrics) error
 	WaitServer(ctx context.Context) error
 }
 
 type MetricsStorage interface {
-	UpdateData(memStats runtime.MemStats)
+	Update(sample Sample)
+	Flush() []models.Metrics
+	Restore(metrics []models.Metrics)
 }
 
 type Agent struct {
-	cfg      *Config
-	provider MetricsProvider
-	reporter MetricsReporter
-	Storage  MetricsStorage
-	logger   *zap.SugaredLogger
+	cfg        *Config
+	collectors []Collector
+	reporter   MetricsReporter
+	Storage    MetricsStorage
+	spool      *Spool
+	labels     map[string]string
+	logger     *zap.SugaredLogger
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
 }
 
-func NewAgent(cfg *Config, provider MetricsProvider, reporter MetricsReporter, logger *zap.SugaredLogger, storage MetricsStorage,
+func NewAgent(cfg *Config, collectors []Collector, reporter MetricsReporter, logger *zap.SugaredLogger, storage MetricsStorage,
 ) *Agent {
-	return &Agent{
-		cfg:      cfg,
-		provider: provider,
-		reporter: reporter,
-		logger:   logger,
-		Storage:  storage,
+	a := &Agent{
+		cfg:        cfg,
+		collectors: collectors,
+		reporter:   reporter,
+		logger:     logger,
+		Storage:    storage,
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	if cfg.SpoolFile != "" {
+		a.spool = NewSpool(cfg.SpoolFile, cfg.SpoolMaxSize)
+	}
+	labels, err := cfg.MetricLabels()
+	if err != nil {
+		logger.Warnw("Ignoring invalid metric labels", "error", err)
 	}
+	a.labels = labels
+	return a
 }
 
-func (a *Agent) Start(ctx context.Context) error {
-	pollTicker := time.NewTicker(time.Duration(a.cfg.PollInterval) * time.Second)
-	reportTicker := time.NewTicker(time.Duration(a.cfg.ReportInterval) * time.Second)
-	defer pollTicker.Stop()
-	defer reportTicker.Stop()
+// Run polls collectors and reports metrics until Stop is called or ctx is cancelled.
+// Polling and reporting run in separate goroutines, reports are sent by a pool of RateLimit workers.
+// On shutdown Run waits for in-flight reports and sends the metrics polled since the last report,
+// both bounded by ShutdownTimeout. It returns nil after Stop and ctx.Err() after cancellation.
+func (a *Agent) Run(ctx context.Context) error {
+	defer close(a.done)
 
 	a.logger.Infof("Agent started")
 	a.logger.Infof("Pool interval %v", a.cfg.PollInterval)
 	a.logger.Infof("Reporting interval %v", a.cfg.ReportInterval)
+	a.logger.Infof("Rate limit %v", a.cfg.RateLimit)
 
-	err := a.reporter.WaitServer(ctx)
+	loopCtx, cancelLoop := context.WithCancel(ctx)
+	defer cancelLoop()
+	go func() {
+		select {
+		case <-a.stop:
+			cancelLoop()
+		case <-loopCtx.Done():
+		}
+	}()
+
+	err := a.reporter.WaitServer(loopCtx)
 	if err != nil {
+		if loopCtx.Err() != nil {
+			return ctx.Err()
+		}
 		a.logger.Fatalf("Can't start agent! Server unreachable %v", err)
 	}
 
+	// Sends outlive the loops so that in-flight reports can finish during shutdown.
+	sendCtx, cancelSend := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancelSend()
+
+	jobs := make(chan report, a.cfg.RateLimit)
+
+	var workers sync.WaitGroup
+	for i := 0; i < a.cfg.RateLimit; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			a.sendWorker(sendCtx, jobs)
+		}()
+	}
+
+	var poller sync.WaitGroup
+	poller.Add(1)
+	go func() {
+		defer poller.Done()
+		a.pollLoop(loopCtx)
+	}()
+
+	a.reportLoop(loopCtx, jobs)
+	poller.Wait()
+
+	a.logger.Infof("Agent stopping, sending pending metrics")
+	deadline := time.AfterFunc(time.Duration(a.cfg.ShutdownTimeout)*time.Second, cancelSend)
+	defer deadline.Stop()
+
+	close(jobs)
+	workers.Wait()
+	a.finalReport(sendCtx)
+
+	a.logger.Infof("Agent stopped")
+	return ctx.Err()
+}
+
+// Stop asks Run to shut down and waits until it returns or ctx is done.
+// Stop must only be called after Run was started.
+func (a *Agent) Stop(ctx context.Context) error {
+	a.stopOnce.Do(func() { close(a.stop) })
+	select {
+	case <-a.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// finalReport sends the metrics polled since the last report tick.
+func (a *Agent) finalReport(ctx context.Context) {
+	metrics := a.Storage.Flush()
+	if len(metrics) == 0 {
+		return
+	}
+	a.attachLabels(metrics)
+	a.deliver(ctx, report{metrics: metrics, flushedAt: time.Now()})
+}
+
+func (a *Agent) pollLoop(ctx context.Context) {
+	pollTicker := time.NewTicker(time.Duration(a.cfg.PollInterval) * time.Second)
+	defer pollTicker.Stop()
+
 	for {
 		select {
 		case <-pollTicker.C:
-			a.Storage.UpdateData(a.provider.Poll())
+			a.poll(ctx)
 			a.logger.Infof("Pool metric")
+		case <-ctx.Done():
+			return
+		}
+	}
+}
 
-		case <-reportTicker.C:
+// reportLoop queues flushed metrics on every report tick, ticks with nothing polled are skipped.
+// When all workers are busy and the queue is full the metrics are restored for the next tick.
+func (a *Agent) reportLoop(ctx context.Context, jobs chan<- report) {
+	reportTicker := time.NewTicker(time.Duration(a.cfg.ReportInterval) * time.Second)
+	defer reportTicker.Stop()
 
-			err := a.reporter.Report(ctx, a.Storage.(Metrics))
-			if err != nil {
-				a.logger.Warnw("Failed to report metrics",
-					zap.Reflect("metrics", a.Storage.(Metrics)),
-					zap.Error(err),
-				)
+	for {
+		select {
+		case <-reportTicker.C:
+			metrics := a.Storage.Flush()
+			if len(metrics) == 0 {
+				continue
+			}
+			a.attachLabels(metrics)
+			select {
+			case jobs <- report{metrics: metrics, flushedAt: time.Now()}:
+			default:
+				a.Storage.Restore(metrics)
+				a.logger.Warnw("Report queue is full, skipping report")
 			}
-			a.logger.Infow("Reported metric", "metric", zap.Reflect("metrics", a.Storage.(Metrics)))
-
 		case <-ctx.Done():
-			return ctx.Err()
+			return
 		}
 	}
 }
+
+// attachLabels sets the agent labels on every metric.
+func (a *Agent) attachLabels(metrics []models.Metrics) {
+	if len(a.labels) == 0 {
+		return
+	}
+	for i := range metrics {
+		metrics[i].Labels = a.labels
+	}
+}
+
+// report is a batch of flushed metrics queued for delivery.
+type report struct {
+	metrics   []models.Metrics
+	flushedAt time.Time
+}
+
+func (a *Agent) sendWorker(ctx context.Context, jobs <-chan report) {
+	for job := range jobs {
+		a.deliver(ctx, job)
+	}
+}
+
+// deliver reports metrics, replaying the spool first so that batches reach the server in order.
+// Undelivered metrics go to the spool, or back to the storage when no spool is configured.
+// Delivered reports are recorded in the spool so that older spooled gauges are not replayed over them.
+func (a *Agent) deliver(ctx context.Context, job report) {
+	if a.spool != nil {
+		if err := a.spool.Replay(ctx, a.reporter.Report); err != nil {
+			a.logger.Warnw("Failed to replay spooled metrics", zap.Error(err))
+			a.saveUndelivered(job)
+			return
+		}
+	}
+
+	err := a.reporter.Report(ctx, job.metrics)
+	if err != nil {
+		a.logger.Warnw("Failed to report metrics",
+			zap.Reflect("metrics", job.metrics),
+			zap.Error(err),
+		)
+		a.saveUndelivered(job)
+		return
+	}
+	if a.spool != nil {
+		a.spool.Delivered(job.flushedAt)
+	}
+	a.logger.Infow("Reported metric", "metric", zap.Reflect("metrics", job.metrics))
+}
+
+func (a *Agent) saveUndelivered(job report) {
+	if a.spool == nil {
+		a.Storage.Restore(job.metrics)
+		return
+	}
+
+	err := a.spool.Append(job.metrics, job.flushedAt)
+	switch {
+	case errors.Is(err, ErrSpoolFull):
+		a.logger.Warnw("Spool is full, dropped the oldest reports", zap.Error(err))
+	case err != nil:
+		a.logger.Errorw("Failed to spool metrics", zap.Error(err))
+		a.Storage.Restore(job.metrics)
+	}
+}
+
+// poll runs every collector in its own goroutine and waits for all of them.
+func (a *Agent) poll(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, collector := range a.collectors {
+		wg.Add(1)
+		go func(collector Collector) {
+			defer wg.Done()
+			sample, err := collector.Collect(ctx)
+			if err != nil {
+				a.logger.Warnw("Failed to collect metrics", zap.Error(err))
+				return
+			}
+			a.Storage.Update(sample)
+		}(collector)
+	}
+	wg.Wait()
+}
@@ -1,63 +1,351 @@
 package agent_test
 
 import (
-	"github.com/fireflg/ago-musthave-metrics-tpl/internal/agent"
+	"context"
+	"errors"
 	"runtime"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/fireflg/ago-musthave-metrics-tpl/internal/agent"
+	models "github.com/fireflg/ago-musthave-metrics-tpl/internal/model"
+	"github.com/fireflg/ago-musthave-metrics-tpl/internal/repository/memory"
+	"github.com/fireflg/ago-musthave-metrics-tpl/internal/service"
+	"go.uber.org/zap"
 )
 
-type fakeProvider struct{}
+type fakeCollector struct{}
 
-func (f *fakeProvider) Poll() runtime.MemStats {
-	return runtime.MemStats{Alloc: 100, HeapAlloc: 200}
+func (f *fakeCollector) Collect(ctx context.Context) (agent.Sample, error) {
+	return agent.MemStatsSample(runtime.MemStats{Alloc: 100, HeapAlloc: 200}), nil
 }
 
 type fakeReporter struct {
-	Reported map[string]float64
+	Reported map[string]models.Metrics
 }
 
 func newFakeReporter() *fakeReporter {
-	return &fakeReporter{Reported: make(map[string]float64)}
+	return &fakeReporter{Reported: make(map[string]models.Metrics)}
 }
 
-func (r *fakeReporter) Report(metric string, value float64) error {
-	r.Reported[metric] = value
+func (r *fakeReporter) Report(ctx context.Context, metrics []models.Metrics) error {
+	for _, metric := range metrics {
+		r.Reported[metric.ID] = metric
+	}
 	return nil
 }
 
-func TestMetrics_UpdateData(t *testing.T) {
-	storage := agent.Metrics(make(map[string]float64))
+func TestMetrics_Update(t *testing.T) {
+	storage := agent.NewMetrics()
 
 	memStats := runtime.MemStats{Alloc: 100, HeapAlloc: 200}
-	storage.UpdateData(memStats)
+	storage.Update(agent.MemStatsSample(memStats))
 
-	if storage["Alloc"] != 100 {
-		t.Fatalf("Alloc = %v, want 100", storage["Alloc"])
+	if storage.Gauges["Alloc"] != 100 {
+		t.Fatalf("Alloc = %v, want 100", storage.Gauges["Alloc"])
 	}
-	if storage["HeapAlloc"] != 200 {
-		t.Fatalf("HeapAlloc = %v, want 200", storage["HeapAlloc"])
+	if storage.Gauges["HeapAlloc"] != 200 {
+		t.Fatalf("HeapAlloc = %v, want 200", storage.Gauges["HeapAlloc"])
 	}
-	if storage["PollCount"] != 1 {
-		t.Fatalf("PollCount = %v, want 1", storage["PollCount"])
+	if storage.Counters["PollCount"] != 1 {
+		t.Fatalf("PollCount = %v, want 1", storage.Counters["PollCount"])
 	}
-	if _, ok := storage["RandomValue"]; !ok {
+	if _, ok := storage.Gauges["RandomValue"]; !ok {
 		t.Fatalf("RandomValue key missing")
 	}
 }
 
+func TestMetrics_UpdateMergesCollectors(t *testing.T) {
+	storage := agent.NewMetrics()
+
+	storage.Update(agent.Sample{
+		Gauges:   map[string]float64{"Alloc": 1},
+		Counters: map[string]int64{"PollCount": 1},
+	})
+	storage.Update(agent.Sample{
+		Gauges:   map[string]float64{"Alloc": 2, "TotalMemory": 1024},
+		Counters: map[string]int64{"PollCount": 1},
+	})
+
+	if storage.Gauges["Alloc"] != 2 {
+		t.Fatalf("Alloc = %v, want 2", storage.Gauges["Alloc"])
+	}
+	if storage.Gauges["TotalMemory"] != 1024 {
+		t.Fatalf("TotalMemory = %v, want 1024", storage.Gauges["TotalMemory"])
+	}
+	if storage.Counters["PollCount"] != 2 {
+		t.Fatalf("PollCount = %v, want 2", storage.Counters["PollCount"])
+	}
+}
+
+func TestNewCollectors(t *testing.T) {
+	agent.RegisterCollector("fake", func() agent.Collector { return &fakeCollector{} })
+
+	collectors, err := agent.NewCollectors("runtime, fake")
+	if err != nil {
+		t.Fatalf("NewCollectors: %v", err)
+	}
+	if len(collectors) != 2 {
+		t.Fatalf("len(collectors) = %v, want 2", len(collectors))
+	}
+
+	if _, err := agent.NewCollectors("unknown"); err == nil {
+		t.Fatalf("expected error for unknown collector")
+	}
+	if _, err := agent.NewCollectors(""); err == nil {
+		t.Fatalf("expected error for empty collector list")
+	}
+}
+
 func TestReporter(t *testing.T) {
-	storage := agent.Metrics(make(map[string]float64))
-	provider := &fakeProvider{}
+	storage := agent.NewMetrics()
+	collector := &fakeCollector{}
 	reporter := newFakeReporter()
-	storage.UpdateData(provider.Poll())
 
-	for metric, value := range storage {
-		if err := reporter.Report(metric, value); err != nil {
-			t.Fatalf("Failed to report metric: %v", err)
-		}
+	sample, err := collector.Collect(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to collect metrics: %v", err)
+	}
+	storage.Update(sample)
+
+	if err := reporter.Report(context.Background(), storage.Flush()); err != nil {
+		t.Fatalf("Failed to report metric: %v", err)
 	}
 
 	if len(reporter.Reported) == 0 {
 		t.Fatalf("No metrics reported")
 	}
+	if reporter.Reported["PollCount"].MType != models.Counter {
+		t.Fatalf("PollCount type = %v, want counter", reporter.Reported["PollCount"].MType)
+	}
+}
+
+type slowReporter struct {
+	mu            sync.Mutex
+	inFlight      int
+	maxInFlight   int
+	reportStarted int
+}
+
+func (r *slowReporter) WaitServer(ctx context.Context) error {
+	return nil
+}
+
+func (r *slowReporter) Report(ctx context.Context, metrics []models.Metrics) error {
+	r.mu.Lock()
+	r.inFlight++
+	r.reportStarted++
+	if r.inFlight > r.maxInFlight {
+		r.maxInFlight = r.inFlight
+	}
+	r.mu.Unlock()
+
+	<-ctx.Done()
+
+	r.mu.Lock()
+	r.inFlight--
+	r.mu.Unlock()
+	return ctx.Err()
+}
+
+func TestAgent_SlowServerDoesNotBlockPolling(t *testing.T) {
+	cfg := &agent.Config{PollInterval: 1, ReportInterval: 1, RateLimit: 2}
+	storage := agent.NewMetrics()
+	reporter := &slowReporter{}
+	a := agent.NewAgent(cfg, []agent.Collector{&fakeCollector{}}, reporter, zap.NewNop().Sugar(), storage)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 4500*time.Millisecond)
+	defer cancel()
+
+	err := a.Run(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Run() = %v, want deadline exceeded", err)
+	}
+
+	if polls := storage.Counters["PollCount"]; polls < 3 {
+		t.Fatalf("PollCount = %v, want at least 3 polls while reports hang", polls)
+	}
+	if reporter.maxInFlight > cfg.RateLimit {
+		t.Fatalf("max in-flight reports = %v, want <= %v", reporter.maxInFlight, cfg.RateLimit)
+	}
+	if reporter.reportStarted < cfg.RateLimit {
+		t.Fatalf("started reports = %v, want at least %v", reporter.reportStarted, cfg.RateLimit)
+	}
+}
+
+// serviceReporter delivers reports straight into a server side service and fails the listed calls.
+type serviceReporter struct {
+	service service.MetricsService
+	failOn  map[int]bool
+	calls   int
+}
+
+func (r *serviceReporter) WaitServer(ctx context.Context) error {
+	return nil
+}
+
+func (r *serviceReporter) Report(ctx context.Context, metrics []models.Metrics) error {
+	r.calls++
+	if r.failOn[r.calls] {
+		return errors.New("server unavailable")
+	}
+	return r.service.SetMetricBatch(ctx, metrics)
+}
+
+func TestMetrics_FlushResetsCounters(t *testing.T) {
+	storage := agent.NewMetrics()
+	storage.Update(agent.MemStatsSample(runtime.MemStats{}))
+	storage.Update(agent.MemStatsSample(runtime.MemStats{}))
+
+	first := storage.Flush()
+	if delta := findMetric(first, "PollCount").Delta; delta == nil || *delta != 2 {
+		t.Fatalf("PollCount delta = %v, want 2", delta)
+	}
+
+	second := storage.Flush()
+	if metric := findMetric(second, "PollCount"); metric.ID != "" {
+		t.Fatalf("PollCount reported again after flush: %v", *metric.Delta)
+	}
+	if metric := findMetric(second, "Alloc"); metric.Value == nil {
+		t.Fatalf("Alloc gauge missing after flush")
+	}
+
+	storage.Restore(first)
+	storage.Update(agent.MemStatsSample(runtime.MemStats{}))
+	if delta := findMetric(storage.Flush(), "PollCount").Delta; delta == nil || *delta != 3 {
+		t.Fatalf("PollCount delta after restore = %v, want 3", delta)
+	}
+}
+
+// countingCollector counts the polls made by the agent.
+type countingCollector struct {
+	fakeCollector
+	polls atomic.Int64
+}
+
+func (c *countingCollector) Collect(ctx context.Context) (agent.Sample, error) {
+	c.polls.Add(1)
+	return c.fakeCollector.Collect(ctx)
+}
+
+func TestCounterTotalsMatchPolls(t *testing.T) {
+	svc := service.NewMetricsService(memory.NewMemoryRepository())
+	reporter := &serviceReporter{
+		service: svc,
+		failOn:  map[int]bool{2: true, 3: true},
+	}
+	collector := &countingCollector{}
+	cfg := &agent.Config{PollInterval: 1, ReportInterval: 1, RateLimit: 1, ShutdownTimeout: 5}
+	a := agent.NewAgent(cfg, []agent.Collector{collector}, reporter, zap.NewNop().Sugar(), agent.NewMetrics())
+
+	done := make(chan error, 1)
+	go func() {
+		done <- a.Run(context.Background())
+	}()
+	time.Sleep(4500 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := a.Stop(ctx); err != nil {
+		t.Fatalf("Stop() = %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Run() = %v, want nil after Stop", err)
+	}
+	if reporter.calls < 3 {
+		t.Fatalf("reports = %v, want the failing reports to be made", reporter.calls)
+	}
+
+	labels, _ := cfg.MetricLabels()
+	metric, err := svc.GetLabeledMetric(models.Counter, "PollCount", labels)
+	if err != nil {
+		t.Fatalf("GetLabeledMetric: %v", err)
+	}
+	if polls := collector.polls.Load(); *metric.Delta != polls {
+		t.Fatalf("server PollCount = %v, want %v", *metric.Delta, polls)
+	}
+}
+
+func TestAgent_StopSendsPendingMetrics(t *testing.T) {
+	svc := service.NewMetricsService(memory.NewMemoryRepository())
+	reporter := &serviceReporter{service: svc}
+	cfg := &agent.Config{PollInterval: 1, ReportInterval: 60, RateLimit: 1, ShutdownTimeout: 5}
+	a := agent.NewAgent(cfg, []agent.Collector{&fakeCollector{}}, reporter, zap.NewNop().Sugar(), agent.NewMetrics())
+
+	done := make(chan error, 1)
+	go func() {
+		done <- a.Run(context.Background())
+	}()
+	time.Sleep(2500 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := a.Stop(ctx); err != nil {
+		t.Fatalf("Stop() = %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Run() = %v, want nil after Stop", err)
+	}
+
+	labels, _ := cfg.MetricLabels()
+	metric, err := svc.GetLabeledMetric(models.Counter, "PollCount", labels)
+	if err != nil {
+		t.Fatalf("GetLabeledMetric: %v", err)
+	}
+	if *metric.Delta < 2 {
+		t.Fatalf("server PollCount = %v, want the polls made before Stop", *metric.Delta)
+	}
+}
+
+func TestAgent_SkipsEmptyReports(t *testing.T) {
+	reporter := &serviceReporter{service: service.NewMetricsService(memory.NewMemoryRepository())}
+	cfg := &agent.Config{PollInterval: 60, ReportInterval: 1, RateLimit: 1, ShutdownTimeout: 5}
+	a := agent.NewAgent(cfg, []agent.Collector{&fakeCollector{}}, reporter, zap.NewNop().Sugar(), agent.NewMetrics())
+
+	done := make(chan error, 1)
+	go func() {
+		done <- a.Run(context.Background())
+	}()
+	time.Sleep(2500 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := a.Stop(ctx); err != nil {
+		t.Fatalf("Stop() = %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Run() = %v, want nil after Stop", err)
+	}
+	if reporter.calls != 0 {
+		t.Fatalf("reports = %v, want none before the first poll", reporter.calls)
+	}
+}
+
+func TestAgent_StopBoundsInFlightReports(t *testing.T) {
+	cfg := &agent.Config{PollInterval: 1, ReportInterval: 1, RateLimit: 1, ShutdownTimeout: 1}
+	a := agent.NewAgent(cfg, []agent.Collector{&fakeCollector{}}, &slowReporter{}, zap.NewNop().Sugar(), agent.NewMetrics())
+
+	go a.Run(context.Background())
+	time.Sleep(1500 * time.Millisecond)
+
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := a.Stop(ctx); err != nil {
+		t.Fatalf("Stop() = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Fatalf("Stop took %v, want it bounded by the shutdown timeout", elapsed)
+	}
+}
+
+func findMetric(metrics []models.Metrics, id string) models.Metrics {
+	for _, metric := range metrics {
+		if metric.ID == id {
+			return metric
+		}
+	}
+	return models.Metrics{}
 }
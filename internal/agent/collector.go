@@ -0,0 +1,64 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Sample is a set of typed values gathered by a Collector in a single poll.
+type Sample struct {
+	Gauges   map[string]float64
+	Counters map[string]int64
+}
+
+func NewSample() Sample {
+	return Sample{
+		Gauges:   make(map[string]float64),
+		Counters: make(map[string]int64),
+	}
+}
+
+// Collector is a single source of metrics polled by the agent.
+type Collector interface {
+	Collect(ctx context.Context) (Sample, error)
+}
+
+var (
+	collectorsMu sync.Mutex
+	collectors   = map[string]func() Collector{
+		"runtime": func() Collector { return &RuntimeCollector{} },
+		"system":  func() Collector { return NewSystemCollector("/proc") },
+	}
+)
+
+// RegisterCollector makes a collector available for selection by name in the agent config.
+func RegisterCollector(name string, factory func() Collector) {
+	collectorsMu.Lock()
+	defer collectorsMu.Unlock()
+	collectors[name] = factory
+}
+
+// NewCollectors builds collectors from a comma separated list of registered names.
+func NewCollectors(names string) ([]Collector, error) {
+	collectorsMu.Lock()
+	defer collectorsMu.Unlock()
+
+	var result []Collector
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		factory, ok := collectors[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown collector: %s", name)
+		}
+		result = append(result, factory())
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("no collectors enabled")
+	}
+	return result, nil
+}
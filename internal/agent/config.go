@@ -4,13 +4,48 @@ import (
 	"flag"
 	"fmt"
 	"github.com/caarlos0/env"
+	"os"
 	"strings"
 )
 
 type Config struct {
-	ServerURL      string `env:"ADDRESS" envDefault:"http://localhost:8080"`
-	PollInterval   int    `env:"POLL_INTERVAL" envDefault:"2"`
-	ReportInterval int    `env:"REPORT_INTERVAL" envDefault:"10"`
+	ServerURL       string `env:"ADDRESS" envDefault:"http://localhost:8080"`
+	PollInterval    int    `env:"POLL_INTERVAL" envDefault:"2"`
+	ReportInterval  int    `env:"REPORT_INTERVAL" envDefault:"10"`
+	Key             string `env:"KEY" envDefault:""`
+	CryptoKey       string `env:"CRYPTO_KEY" envDefault:""`
+	Collectors      string `env:"COLLECTORS" envDefault:"runtime"`
+	RateLimit       int    `env:"RATE_LIMIT" envDefault:"1"`
+	SpoolFile       string `env:"SPOOL_FILE" envDefault:""`
+	SpoolMaxSize    int64  `env:"SPOOL_MAX_SIZE" envDefault:"10485760"`
+	Labels          string `env:"LABELS" envDefault:""`
+	AgentID         string `env:"AGENT_ID" envDefault:""`
+	Transport       string `env:"TRANSPORT" envDefault:"http"`
+	GRPCAddress     string `env:"GRPC_ADDRESS" envDefault:"localhost:3200"`
+	ShutdownTimeout int    `env:"SHUTDOWN_TIMEOUT" envDefault:"5"`
+}
+
+// MetricLabels parses Labels ("name=value,name2=value2") into the label set attached to
+// every reported metric. The host label defaults to the machine hostname.
+func (c *Config) MetricLabels() (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, pair := range strings.Split(c.Labels, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid label %q, expected name=value", pair)
+		}
+		labels[name] = value
+	}
+	if _, ok := labels["host"]; !ok {
+		if host, err := os.Hostname(); err == nil {
+			labels["host"] = host
+		}
+	}
+	return labels, nil
 }
 
 func LoadAgentConfig() (*Config, error) {
@@ -24,6 +59,17 @@ func LoadAgentConfig() (*Config, error) {
 	flag.StringVar(&cfg.ServerURL, "a", cfg.ServerURL, "Server address (default: from env or 'localhost:8080')")
 	flag.IntVar(&cfg.PollInterval, "p", cfg.PollInterval, "Poll interval in seconds (default: from env or 10)")
 	flag.IntVar(&cfg.ReportInterval, "r", cfg.ReportInterval, "Report interval in seconds (default: from env or 5)")
+	flag.StringVar(&cfg.Key, "k", cfg.Key, "Key to sign request bodies (HMAC-SHA256)")
+	flag.StringVar(&cfg.CryptoKey, "crypto-key", cfg.CryptoKey, "Path to the server RSA public key used to encrypt HTTP report bodies")
+	flag.IntVar(&cfg.RateLimit, "l", cfg.RateLimit, "Max number of concurrent outbound requests (default: from env or 1)")
+	flag.StringVar(&cfg.SpoolFile, "s", cfg.SpoolFile, "Path to spool undelivered reports (empty = keep them in memory)")
+	flag.Int64Var(&cfg.SpoolMaxSize, "spool-max-size", cfg.SpoolMaxSize, "Max spool file size in bytes, batches are merged and then the oldest dropped to stay below it")
+	flag.StringVar(&cfg.Transport, "transport", cfg.Transport, "Transport used to send reports: http or grpc")
+	flag.StringVar(&cfg.GRPCAddress, "g", cfg.GRPCAddress, "gRPC server address used with -transport=grpc")
+	flag.StringVar(&cfg.AgentID, "id", cfg.AgentID, "Stable agent ID sent with every report (default: hostname)")
+	flag.StringVar(&cfg.Labels, "labels", cfg.Labels, "Comma separated name=value labels attached to every metric (host defaults to the hostname)")
+	flag.IntVar(&cfg.ShutdownTimeout, "shutdown-timeout", cfg.ShutdownTimeout, "Seconds to finish in-flight and final reports on shutdown")
+	flag.StringVar(&cfg.Collectors, "c", cfg.Collectors, "Comma separated list of enabled collectors: runtime, system (default: runtime)")
 
 	if unknownFlags := flag.Args(); len(unknownFlags) > 0 {
 		return nil, fmt.Errorf("invalid flags: %v", unknownFlags)
@@ -31,6 +77,28 @@ func LoadAgentConfig() (*Config, error) {
 
 	flag.Parse()
 
+	if cfg.RateLimit < 1 {
+		return nil, fmt.Errorf("rate limit must be positive, got %d", cfg.RateLimit)
+	}
+
+	if cfg.ShutdownTimeout < 0 {
+		return nil, fmt.Errorf("shutdown timeout must not be negative, got %d", cfg.ShutdownTimeout)
+	}
+
+	if cfg.Transport != "http" && cfg.Transport != "grpc" {
+		return nil, fmt.Errorf("unknown transport %q, expected http or grpc", cfg.Transport)
+	}
+
+	if _, err := cfg.MetricLabels(); err != nil {
+		return nil, err
+	}
+
+	if cfg.AgentID == "" {
+		if cfg.AgentID, err = os.Hostname(); err != nil {
+			return nil, fmt.Errorf("agent ID is not set and hostname is unavailable: %w", err)
+		}
+	}
+
 	if !strings.Contains(cfg.ServerURL, "http://") {
 		cfg.ServerURL = "http://" + cfg.ServerURL
 	}
@@ -0,0 +1,104 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	models "github.com/fireflg/ago-musthave-metrics-tpl/internal/model"
+	pb "github.com/fireflg/ago-musthave-metrics-tpl/internal/proto"
+	"github.com/fireflg/ago-musthave-metrics-tpl/internal/sign"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+// grpcServiceConfig retries calls the server could not receive, like the HTTP reporter does.
+const grpcServiceConfig = `{
+	"methodConfig": [{
+		"name": [{"service": "metrics.Metrics"}],
+		"retryPolicy": {
+			"maxAttempts": 5,
+			"initialBackoff": "0.5s",
+			"maxBackoff": "3s",
+			"backoffMultiplier": 2,
+			"retryableStatusCodes": ["UNAVAILABLE"]
+		}
+	}]
+}`
+
+// GRPCReporter sends metrics with the UpdateMetrics RPC.
+type GRPCReporter struct {
+	address string
+	conn    *grpc.ClientConn
+	client  pb.MetricsClient
+	key     string
+	agentID string
+}
+
+func NewGRPCReporter(address string, key string, agentID string) (*GRPCReporter, error) {
+	conn, err := grpc.NewClient(address,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultServiceConfig(grpcServiceConfig),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("grpc client: %w", err)
+	}
+
+	return &GRPCReporter{
+		address: address,
+		conn:    conn,
+		client:  pb.NewMetricsClient(conn),
+		key:     key,
+		agentID: agentID,
+	}, nil
+}
+
+// WaitServer blocks until the connection is ready, giving up after 30 seconds.
+func (r *GRPCReporter) WaitServer(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	r.conn.Connect()
+	for {
+		state := r.conn.GetState()
+		if state == connectivity.Ready {
+			return nil
+		}
+		if !r.conn.WaitForStateChange(ctx, state) {
+			return fmt.Errorf("grpc server unreachable: %w", ctx.Err())
+		}
+	}
+}
+
+func (r *GRPCReporter) Report(ctx context.Context, metrics []models.Metrics) error {
+	req := &pb.UpdateMetricsRequest{Metrics: make([]*pb.Metric, 0, len(metrics))}
+	for _, metric := range metrics {
+		m, err := pb.FromModel(metric)
+		if err != nil {
+			return err
+		}
+		req.Metrics = append(req.Metrics, m)
+	}
+
+	md := metadata.Pairs(pb.AgentIDKey, r.agentID, pb.AgentVersionKey, Version)
+	if ip := outboundIP(r.address); ip != "" {
+		md.Set(pb.RealIPKey, ip)
+	}
+	if r.key != "" {
+		data, err := proto.MarshalOptions{Deterministic: true}.Marshal(req)
+		if err != nil {
+			return err
+		}
+		md.Set(pb.HashKey, sign.Sign(data, r.key))
+	}
+
+	_, err := r.client.UpdateMetrics(metadata.NewOutgoingContext(ctx, md), req)
+	return err
+}
+
+func (r *GRPCReporter) Close() error {
+	return r.conn.Close()
+}
@@ -0,0 +1,37 @@
+package agent
+
+import (
+	"net"
+	"net/url"
+)
+
+// outboundIP returns the local address used to reach address (host:port), or "" when
+// no route is found. Dialing UDP only selects a route and sends no packets.
+func outboundIP(address string) string {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return ""
+	}
+	defer conn.Close()
+
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+		return addr.IP.String()
+	}
+	return ""
+}
+
+// serverAddress returns the host:port of a server URL, defaulting the port by scheme.
+func serverAddress(serverURL string) string {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return ""
+	}
+	if u.Port() != "" {
+		return u.Host
+	}
+	port := "80"
+	if u.Scheme == "https" {
+		port = "443"
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
@@ -4,19 +4,32 @@ import (
 	"bytes"
 	"compress/gzip"
 	"context"
+	"crypto/rsa"
 	"encoding/json"
 	"fmt"
+	"github.com/fireflg/ago-musthave-metrics-tpl/internal/encryption"
+	"github.com/fireflg/ago-musthave-metrics-tpl/internal/middleware"
+	models "github.com/fireflg/ago-musthave-metrics-tpl/internal/model"
+	"github.com/fireflg/ago-musthave-metrics-tpl/internal/sign"
 	"github.com/hashicorp/go-retryablehttp"
 	"net/http"
 	"time"
 )
 
+// Version is the agent version reported to the server, set at build time with
+// -ldflags "-X github.com/fireflg/ago-musthave-metrics-tpl/internal/agent.Version=...".
+var Version = "dev"
+
 type Reporter struct {
 	serverURL string
+	key       string
+	agentID   string
+	publicKey *rsa.PublicKey
 	client    *retryablehttp.Client
 }
 
-func NewReporter(serverURL string) *Reporter {
+// NewReporter creates an HTTP reporter, bodies are encrypted for publicKey unless it is nil.
+func NewReporter(serverURL string, key string, agentID string, publicKey *rsa.PublicKey) *Reporter {
 	client := retryablehttp.NewClient()
 	// Временный хардкод параметров
 	client.RetryMax = 15
@@ -26,6 +39,9 @@ func NewReporter(serverURL string) *Reporter {
 
 	return &Reporter{
 		serverURL: serverURL,
+		key:       key,
+		agentID:   agentID,
+		publicKey: publicKey,
 		client:    client,
 	}
 }
@@ -48,27 +64,41 @@ func (r *Reporter) WaitServer(ctx context.Context) error {
 	return nil
 }
 
-func (r *Reporter) Report(ctx context.Context, metrics Metrics) error {
+func (r *Reporter) Report(ctx context.Context, metrics []models.Metrics) error {
 
 	payload, err := r.makePayload(metrics)
 	if err != nil {
 		return err
 	}
 
-	compressed, err := r.compressPayload(payload)
+	body, err := r.compressPayload(payload)
 	if err != nil {
 		return err
 	}
 
+	if r.publicKey != nil {
+		if body, err = encryption.Encrypt(r.publicKey, body); err != nil {
+			return err
+		}
+	}
+
 	url := fmt.Sprintf("%s/updates/", r.serverURL)
 
-	req, err := retryablehttp.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(compressed))
+	req, err := retryablehttp.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
 	if err != nil {
 		return err
 	}
 
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set(models.AgentIDHeader, r.agentID)
+	req.Header.Set(models.AgentVersionHeader, Version)
+	if ip := outboundIP(serverAddress(r.serverURL)); ip != "" {
+		req.Header.Set(middleware.RealIPHeader, ip)
+	}
+	if r.key != "" {
+		req.Header.Set(sign.HeaderName, sign.Sign(body, r.key))
+	}
 
 	resp, err := r.client.Do(req)
 	if err != nil {
@@ -83,29 +113,8 @@ func (r *Reporter) Report(ctx context.Context, metrics Metrics) error {
 	return nil
 }
 
-func (r *Reporter) makePayload(metrics Metrics) ([]byte, error) {
-	var payloadMap []map[string]interface{}
-	for k, v := range metrics {
-		metricType := "gauge"
-		if k == "PollCount" {
-			metricType = "counter"
-		}
-		if metricType == "counter" {
-			payloadMap = append(payloadMap, map[string]interface{}{
-				"id":    k,
-				"delta": int64(v),
-				"type":  metricType,
-			})
-		} else {
-			payloadMap = append(payloadMap, map[string]interface{}{
-				"id":    k,
-				"value": v,
-				"type":  metricType,
-			})
-		}
-	}
-
-	payload, err := json.Marshal(payloadMap)
+func (r *Reporter) makePayload(metrics []models.Metrics) ([]byte, error) {
+	payload, err := json.Marshal(metrics)
 	if err != nil {
 		return nil, err
 	}
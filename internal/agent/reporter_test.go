@@ -0,0 +1,30 @@
+package agent_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fireflg/ago-musthave-metrics-tpl/internal/agent"
+	"github.com/fireflg/ago-musthave-metrics-tpl/internal/middleware"
+	models "github.com/fireflg/ago-musthave-metrics-tpl/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReporter_Headers(t *testing.T) {
+	var header http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Clone()
+	}))
+	defer srv.Close()
+
+	value := 1.5
+	reporter := agent.NewReporter(srv.URL, "", "agent-1", nil)
+	require.NoError(t, reporter.Report(context.Background(), []models.Metrics{{ID: "Alloc", MType: models.Gauge, Value: &value}}))
+
+	assert.Equal(t, "127.0.0.1", header.Get(middleware.RealIPHeader))
+	assert.Equal(t, "agent-1", header.Get(models.AgentIDHeader))
+	assert.Equal(t, "gzip", header.Get("Content-Encoding"))
+}
@@ -0,0 +1,44 @@
+package agent
+
+import (
+	"context"
+	"math/rand"
+	"reflect"
+	"runtime"
+)
+
+// RuntimeCollector reports runtime.MemStats of the agent process.
+type RuntimeCollector struct{}
+
+func (c *RuntimeCollector) Collect(ctx context.Context) (Sample, error) {
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+	return MemStatsSample(memStats), nil
+}
+
+func MemStatsSample(memStats runtime.MemStats) Sample {
+	sample := NewSample()
+	v := reflect.ValueOf(memStats)
+
+	for _, name := range MemStatFields {
+		field := v.FieldByName(name)
+		if field.IsValid() {
+			switch field.Kind() {
+			case reflect.Uint64, reflect.Uint32:
+				sample.Gauges[name] = float64(field.Uint())
+			case reflect.Float64:
+				sample.Gauges[name] = field.Float()
+			case reflect.Int64:
+				sample.Gauges[name] = float64(field.Int())
+			default:
+				sample.Gauges[name] = 0
+			}
+		} else {
+			sample.Gauges[name] = 0
+		}
+	}
+
+	sample.Gauges["RandomValue"] = rand.ExpFloat64()
+	sample.Counters["PollCount"] = 1
+	return sample
+}
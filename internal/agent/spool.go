@@ -0,0 +1,335 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	models "github.com/fireflg/ago-musthave-metrics-tpl/internal/model"
+)
+
+// ErrSpoolFull is returned by Append when the oldest spooled reports were dropped
+// to keep the spool within its max size.
+var ErrSpoolFull = errors.New("spool is full, oldest reports dropped")
+
+// spoolBatch is a line of the spool: an undelivered report and the time its metrics were flushed.
+type spoolBatch struct {
+	FlushedAt time.Time        `json:"flushed_at"`
+	Metrics   []models.Metrics `json:"metrics"`
+}
+
+// Spool is an append-only file of undelivered reports, one JSON batch per line.
+// Batches are replayed in the order they were appended. Gauges flushed before a report
+// that already reached the server are not replayed, so they never overwrite newer values.
+type Spool struct {
+	path    string
+	maxSize int64
+	mu      sync.Mutex
+	// delivered is the flush time of the newest report known to have reached the server.
+	delivered time.Time
+	// replayMu serializes replays, replaying is set while one sends without holding mu.
+	replayMu  sync.Mutex
+	replaying bool
+}
+
+func NewSpool(path string, maxSize int64) *Spool {
+	return &Spool{
+		path:    path,
+		maxSize: maxSize,
+	}
+}
+
+// Delivered records that the report flushed at flushedAt reached the server.
+func (s *Spool) Delivered(flushedAt time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if flushedAt.After(s.delivered) {
+		s.delivered = flushedAt
+	}
+}
+
+// Append stores a batch flushed at flushedAt at the end of the spool.
+// When the spool grows beyond maxSize all batches are merged into one, keeping the newest
+// gauge values and the sum of counter deltas, and the oldest batches are dropped until the
+// merged one fits. Merging waits while a replay is sending, as it would merge batches being delivered.
+func (s *Spool) Append(metrics []models.Metrics, flushedAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if flushedAt.Before(s.delivered) {
+		metrics = withoutGauges(metrics)
+	}
+	if len(metrics) == 0 {
+		return nil
+	}
+
+	line, err := json.Marshal(spoolBatch{FlushedAt: flushedAt, Metrics: metrics})
+	if err != nil {
+		return fmt.Errorf("Spool.Append: marshal json: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return fmt.Errorf("Spool.Append: mkdir: %w", err)
+	}
+
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("Spool.Append: open file: %w", err)
+	}
+	// A line cut short by a crash must not swallow the new batch.
+	if terminated, err := endsWithNewline(file); err != nil {
+		file.Close()
+		return fmt.Errorf("Spool.Append: read file: %w", err)
+	} else if !terminated {
+		line = append([]byte{'\n'}, line...)
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return fmt.Errorf("Spool.Append: write file: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("Spool.Append: sync file: %w", err)
+	}
+	info, err := file.Stat()
+	file.Close()
+	if err != nil {
+		return fmt.Errorf("Spool.Append: stat file: %w", err)
+	}
+
+	if s.maxSize <= 0 || info.Size() <= s.maxSize || s.replaying {
+		return nil
+	}
+
+	batches, err := s.read()
+	if err != nil {
+		return err
+	}
+	dropped := false
+	for ; len(batches) > 0; batches = batches[1:] {
+		merged := mergeBatches(batches)
+		line, err := json.Marshal(merged)
+		if err != nil {
+			return fmt.Errorf("Spool.Append: marshal json: %w", err)
+		}
+		if int64(len(line)+1) <= s.maxSize {
+			batches = []spoolBatch{merged}
+			break
+		}
+		dropped = true
+	}
+	if err := s.write(batches); err != nil {
+		return err
+	}
+	if dropped {
+		return ErrSpoolFull
+	}
+	return nil
+}
+
+// Replay sends spooled batches in order and removes the delivered ones.
+// It stops at the first failed batch and returns its error.
+// Batches are sent without holding the spool, so Append is not blocked by the network;
+// appended batches follow the replayed ones and are kept.
+func (s *Spool) Replay(ctx context.Context, send func(ctx context.Context, metrics []models.Metrics) error) error {
+	s.replayMu.Lock()
+	defer s.replayMu.Unlock()
+
+	s.mu.Lock()
+	batches, err := s.read()
+	delivered := s.delivered
+	s.replaying = err == nil
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	sent := 0
+	var sendErr error
+	for _, batch := range batches {
+		metrics := batch.Metrics
+		if batch.FlushedAt.Before(delivered) {
+			metrics = withoutGauges(metrics)
+		}
+		if len(metrics) > 0 {
+			if sendErr = send(ctx, metrics); sendErr != nil {
+				break
+			}
+		}
+		if batch.FlushedAt.After(delivered) {
+			delivered = batch.FlushedAt
+		}
+		sent++
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.replaying = false
+	if delivered.After(s.delivered) {
+		s.delivered = delivered
+	}
+	if sent == 0 {
+		return sendErr
+	}
+
+	current, err := s.read()
+	if err != nil {
+		return err
+	}
+	if sent > len(current) {
+		sent = len(current)
+	}
+	if err := s.write(current[sent:]); err != nil {
+		return err
+	}
+	return sendErr
+}
+
+// Len returns the number of spooled batches.
+func (s *Spool) Len() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	batches, err := s.read()
+	return len(batches), err
+}
+
+// read returns all batches of the spool. A line cut short by a crash is skipped.
+func (s *Spool) read() ([]spoolBatch, error) {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Spool.read: read file: %w", err)
+	}
+
+	var batches []spoolBatch
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), len(data)+1)
+	for scanner.Scan() {
+		var batch spoolBatch
+		if err := json.Unmarshal(scanner.Bytes(), &batch); err != nil {
+			continue
+		}
+		batches = append(batches, batch)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Spool.read: %w", err)
+	}
+	return batches, nil
+}
+
+// write replaces the spool with batches through a temporary file.
+// The temporary file is synced before the rename so a crash leaves either spool intact.
+func (s *Spool) write(batches []spoolBatch) error {
+	if len(batches) == 0 {
+		if err := os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Spool.write: remove file: %w", err)
+		}
+		return nil
+	}
+
+	var buf bytes.Buffer
+	for _, batch := range batches {
+		line, err := json.Marshal(batch)
+		if err != nil {
+			return fmt.Errorf("Spool.write: marshal json: %w", err)
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+
+	tmp := s.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("Spool.write: open file: %w", err)
+	}
+	if _, err := file.Write(buf.Bytes()); err != nil {
+		file.Close()
+		return fmt.Errorf("Spool.write: write file: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("Spool.write: sync file: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("Spool.write: close file: %w", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("Spool.write: rename file: %w", err)
+	}
+	return nil
+}
+
+func endsWithNewline(file *os.File) (bool, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+	if info.Size() == 0 {
+		return true, nil
+	}
+	last := make([]byte, 1)
+	if _, err := file.ReadAt(last, info.Size()-1); err != nil {
+		return false, err
+	}
+	return last[0] == '\n', nil
+}
+
+// withoutGauges returns the counters of metrics.
+func withoutGauges(metrics []models.Metrics) []models.Metrics {
+	counters := make([]models.Metrics, 0, len(metrics))
+	for _, metric := range metrics {
+		if metric.MType != models.Gauge {
+			counters = append(counters, metric)
+		}
+	}
+	return counters
+}
+
+// mergeBatches sums the deltas of every counter series and keeps the gauge value of every
+// series from the most recently flushed batch. Series are told apart by type, name and labels.
+// The merged batch takes the oldest flush time, so its gauges are never taken for newer
+// than they are.
+func mergeBatches(batches []spoolBatch) spoolBatch {
+	var merged spoolBatch
+	index := make(map[string]int)
+	gaugeAt := make(map[string]time.Time)
+	for n, batch := range batches {
+		if n == 0 || batch.FlushedAt.Before(merged.FlushedAt) {
+			merged.FlushedAt = batch.FlushedAt
+		}
+		for _, metric := range batch.Metrics {
+			if (metric.MType != models.Gauge || metric.Value == nil) &&
+				(metric.MType != models.Counter || metric.Delta == nil) {
+				continue
+			}
+			key := metric.MType + "/" + metric.Key()
+			i, ok := index[key]
+			if !ok {
+				index[key] = len(merged.Metrics)
+				merged.Metrics = append(merged.Metrics, metric)
+				gaugeAt[key] = batch.FlushedAt
+				continue
+			}
+			if metric.MType == models.Gauge {
+				if !batch.FlushedAt.Before(gaugeAt[key]) {
+					merged.Metrics[i].Value = metric.Value
+					gaugeAt[key] = batch.FlushedAt
+				}
+			} else {
+				delta := *merged.Metrics[i].Delta + *metric.Delta
+				merged.Metrics[i].Delta = &delta
+			}
+		}
+	}
+	return merged
+}
@@ -0,0 +1,254 @@
+package agent_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fireflg/ago-musthave-metrics-tpl/internal/agent"
+	models "github.com/fireflg/ago-musthave-metrics-tpl/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func counterBatch(id string, delta int64) []models.Metrics {
+	return []models.Metrics{{ID: id, MType: models.Counter, Delta: &delta}}
+}
+
+// flushedAt returns the flush time of the n-th report.
+func flushedAt(n int) time.Time {
+	return time.Date(2026, 1, 1, 0, 0, n, 0, time.UTC)
+}
+
+func TestSpool_ReplayInOrder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spool.jsonl")
+	spool := agent.NewSpool(path, 0)
+
+	require.NoError(t, spool.Append(counterBatch("first", 1), flushedAt(1)))
+	require.NoError(t, spool.Append(counterBatch("second", 2), flushedAt(2)))
+	require.NoError(t, spool.Append(counterBatch("third", 3), flushedAt(3)))
+
+	var sent []string
+	failed := false
+	send := func(ctx context.Context, metrics []models.Metrics) error {
+		if metrics[0].ID == "third" && !failed {
+			failed = true
+			return errors.New("server unavailable")
+		}
+		sent = append(sent, metrics[0].ID)
+		return nil
+	}
+
+	assert.Error(t, spool.Replay(context.Background(), send))
+	assert.Equal(t, []string{"first", "second"}, sent)
+
+	// A new spool on the same path behaves like a restarted agent.
+	restarted := agent.NewSpool(path, 0)
+	n, err := restarted.Len()
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	require.NoError(t, restarted.Replay(context.Background(), send))
+	assert.Equal(t, []string{"first", "second", "third"}, sent)
+
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestSpool_MaxSizeMergesBatches(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spool.jsonl")
+	spool := agent.NewSpool(path, 200)
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, spool.Append(counterBatch("PollCount", 1), flushedAt(i)))
+	}
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.LessOrEqual(t, info.Size(), int64(200))
+
+	var total int64
+	err = spool.Replay(context.Background(), func(ctx context.Context, metrics []models.Metrics) error {
+		for _, metric := range metrics {
+			total += *metric.Delta
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), total)
+}
+
+func TestSpool_MergeKeepsLabels(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spool.jsonl")
+	spool := agent.NewSpool(path, 400)
+
+	batch := func(host string, delta int64, value float64) []models.Metrics {
+		labels := map[string]string{"host": host}
+		return []models.Metrics{
+			{ID: "PollCount", MType: models.Counter, Delta: &delta, Labels: labels},
+			{ID: "Alloc", MType: models.Gauge, Value: &value, Labels: labels},
+		}
+	}
+	for i := 1; i <= 5; i++ {
+		require.NoError(t, spool.Append(batch("a", 1, float64(i)), flushedAt(2*i)))
+		require.NoError(t, spool.Append(batch("b", 2, float64(i*10)), flushedAt(2*i+1)))
+	}
+	n, err := spool.Len()
+	require.NoError(t, err)
+	assert.Less(t, n, 10)
+
+	got := make(map[string]models.Metrics)
+	err = spool.Replay(context.Background(), func(ctx context.Context, metrics []models.Metrics) error {
+		for _, metric := range metrics {
+			if prev, ok := got[metric.MType+metric.Key()]; ok && metric.Delta != nil {
+				delta := *prev.Delta + *metric.Delta
+				metric.Delta = &delta
+			}
+			got[metric.MType+metric.Key()] = metric
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	require.Len(t, got, 4)
+	hostA := models.Metrics{ID: "PollCount", Labels: map[string]string{"host": "a"}}
+	hostB := models.Metrics{ID: "PollCount", Labels: map[string]string{"host": "b"}}
+	assert.Equal(t, int64(5), *got[models.Counter+hostA.Key()].Delta)
+	assert.Equal(t, int64(10), *got[models.Counter+hostB.Key()].Delta)
+	hostA.ID, hostB.ID = "Alloc", "Alloc"
+	assert.Equal(t, 5.0, *got[models.Gauge+hostA.Key()].Value)
+	assert.Equal(t, 50.0, *got[models.Gauge+hostB.Key()].Value)
+	assert.Equal(t, map[string]string{"host": "b"}, got[models.Gauge+hostB.Key()].Labels)
+}
+
+func TestSpool_AppendDuringReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spool.jsonl")
+	spool := agent.NewSpool(path, 200)
+	require.NoError(t, spool.Append(counterBatch("first", 1), flushedAt(0)))
+
+	var sent []string
+	send := func(ctx context.Context, metrics []models.Metrics) error {
+		if metrics[0].ID == "first" {
+			// The spool is not held while sending, and merging waits for the replay.
+			for i := 0; i < 5; i++ {
+				require.NoError(t, spool.Append(counterBatch("late", 1), flushedAt(i+1)))
+			}
+		}
+		sent = append(sent, metrics[0].ID)
+		return nil
+	}
+	require.NoError(t, spool.Replay(context.Background(), send))
+	assert.Equal(t, []string{"first"}, sent)
+
+	n, err := spool.Len()
+	require.NoError(t, err)
+	assert.Equal(t, 5, n)
+
+	var total int64
+	require.NoError(t, spool.Append(counterBatch("late", 1), flushedAt(6)))
+	err = spool.Replay(context.Background(), func(ctx context.Context, metrics []models.Metrics) error {
+		for _, metric := range metrics {
+			total += *metric.Delta
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int64(6), total)
+}
+
+func TestSpool_FullDropsOldest(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spool.jsonl")
+	spool := agent.NewSpool(path, 120)
+
+	require.NoError(t, spool.Append(counterBatch("first", 1), flushedAt(1)))
+	err := spool.Append(counterBatch("second", 1), flushedAt(2))
+	assert.ErrorIs(t, err, agent.ErrSpoolFull)
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.LessOrEqual(t, info.Size(), int64(120))
+
+	var sent []string
+	err = spool.Replay(context.Background(), func(ctx context.Context, metrics []models.Metrics) error {
+		for _, metric := range metrics {
+			sent = append(sent, metric.ID)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"second"}, sent)
+}
+
+func TestSpool_SkipsStaleGauges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spool.jsonl")
+	spool := agent.NewSpool(path, 0)
+
+	batch := func(delta int64, value float64) []models.Metrics {
+		return []models.Metrics{
+			{ID: "PollCount", MType: models.Counter, Delta: &delta},
+			{ID: "Alloc", MType: models.Gauge, Value: &value},
+		}
+	}
+	// A newer report reached the server before an older one failed.
+	spool.Delivered(flushedAt(2))
+	require.NoError(t, spool.Append(batch(1, 1), flushedAt(1)))
+	require.NoError(t, spool.Append(batch(2, 3), flushedAt(3)))
+
+	var sent []models.Metrics
+	err := spool.Replay(context.Background(), func(ctx context.Context, metrics []models.Metrics) error {
+		sent = append(sent, metrics...)
+		return nil
+	})
+	require.NoError(t, err)
+
+	require.Len(t, sent, 3)
+	assert.Equal(t, models.Counter, sent[0].MType)
+	assert.Equal(t, int64(1), *sent[0].Delta)
+	assert.Equal(t, 3.0, *sent[2].Value)
+}
+
+func TestSpool_MergeKeepsNewestGauge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spool.jsonl")
+	spool := agent.NewSpool(path, 150)
+
+	gauge := func(value float64) []models.Metrics {
+		return []models.Metrics{{ID: "Alloc", MType: models.Gauge, Value: &value}}
+	}
+	// Workers may spool their batches out of order.
+	require.NoError(t, spool.Append(gauge(2), flushedAt(2)))
+	require.NoError(t, spool.Append(gauge(1), flushedAt(1)))
+
+	n, err := spool.Len()
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	var sent []models.Metrics
+	err = spool.Replay(context.Background(), func(ctx context.Context, metrics []models.Metrics) error {
+		sent = append(sent, metrics...)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Len(t, sent, 1)
+	assert.Equal(t, 2.0, *sent[0].Value)
+}
+
+func TestSpool_SkipsTruncatedLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spool.jsonl")
+	spool := agent.NewSpool(path, 0)
+	require.NoError(t, spool.Append(counterBatch("PollCount", 1), flushedAt(1)))
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = file.WriteString(`{"flushed_at":"2026-01-01T00:00:02Z","metrics":[{"id":"PollCount","ty`)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	require.NoError(t, spool.Append(counterBatch("PollCount", 2), flushedAt(3)))
+
+	n, err := spool.Len()
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+}
@@ -1,34 +1,64 @@
 package agent
 
 import (
-	"math/rand"
-	"reflect"
-	"runtime"
+	"sync"
+
+	models "github.com/fireflg/ago-musthave-metrics-tpl/internal/model"
 )
 
-type Metrics map[string]float64
-
-func (m Metrics) UpdateData(memStats runtime.MemStats) {
-	v := reflect.ValueOf(memStats)
-
-	for _, name := range MemStatFields {
-		field := v.FieldByName(name)
-		if field.IsValid() {
-			switch field.Kind() {
-			case reflect.Uint64:
-				m[name] = float64(field.Uint())
-			case reflect.Float64:
-				m[name] = field.Float()
-			case reflect.Int64:
-				m[name] = float64(field.Int())
-			default:
-				m[name] = 0
-			}
-		} else {
-			m[name] = 0
-		}
+type Metrics struct {
+	mu       sync.Mutex
+	Gauges   map[string]float64
+	Counters map[string]int64
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		Gauges:   make(map[string]float64),
+		Counters: make(map[string]int64),
+	}
+}
+
+// Update stores gauges as last value and adds counters to the accumulated ones.
+func (m *Metrics) Update(sample Sample) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for name, value := range sample.Gauges {
+		m.Gauges[name] = value
+	}
+	for name, delta := range sample.Counters {
+		m.Counters[name] += delta
 	}
+}
+
+// Flush returns the last gauge values and the counter deltas accumulated since the previous flush.
+// Flushed deltas are removed from the storage, undelivered ones must be handed back with Restore.
+func (m *Metrics) Flush() []models.Metrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-	m["RandomValue"] = rand.ExpFloat64()
-	m["PollCount"]++
+	result := make([]models.Metrics, 0, len(m.Gauges)+len(m.Counters))
+	for name, value := range m.Gauges {
+		value := value
+		result = append(result, models.Metrics{ID: name, MType: models.Gauge, Value: &value})
+	}
+	for name, delta := range m.Counters {
+		delta := delta
+		result = append(result, models.Metrics{ID: name, MType: models.Counter, Delta: &delta})
+	}
+	m.Counters = make(map[string]int64)
+	return result
+}
+
+// Restore adds counter deltas of an undelivered report back to the pending ones.
+func (m *Metrics) Restore(metrics []models.Metrics) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, metric := range metrics {
+		if metric.MType == models.Counter && metric.Delta != nil {
+			m.Counters[metric.ID] += *metric.Delta
+		}
+	}
 }
@@ -0,0 +1,143 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// SystemCollector reports host memory and per core CPU utilization read from procfs.
+// Utilization is measured between polls, so it is reported from the second poll on.
+type SystemCollector struct {
+	procPath string
+	mu       sync.Mutex
+	prev     map[int]cpuTimes
+}
+
+type cpuTimes struct {
+	idle  uint64
+	total uint64
+}
+
+func NewSystemCollector(procPath string) *SystemCollector {
+	return &SystemCollector{
+		procPath: procPath,
+		prev:     make(map[int]cpuTimes),
+	}
+}
+
+func (c *SystemCollector) Collect(ctx context.Context) (Sample, error) {
+	sample := NewSample()
+
+	memory, err := c.readMemInfo()
+	if err != nil {
+		return Sample{}, err
+	}
+	sample.Gauges["TotalMemory"] = float64(memory["MemTotal"])
+	sample.Gauges["FreeMemory"] = float64(memory["MemFree"])
+
+	cpus, err := c.readStat()
+	if err != nil {
+		return Sample{}, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for cpu, times := range cpus {
+		prev, ok := c.prev[cpu]
+		c.prev[cpu] = times
+		// Without a previous sample the counters only give the average since boot.
+		if !ok {
+			continue
+		}
+		total := times.total - prev.total
+		idle := times.idle - prev.idle
+
+		var utilization float64
+		if total > 0 {
+			utilization = 100 * float64(total-idle) / float64(total)
+		}
+		sample.Gauges[fmt.Sprintf("CPUutilization%d", cpu+1)] = utilization
+	}
+
+	return sample, nil
+}
+
+// readMemInfo returns /proc/meminfo values in bytes.
+func (c *SystemCollector) readMemInfo() (map[string]uint64, error) {
+	file, err := os.Open(filepath.Join(c.procPath, "meminfo"))
+	if err != nil {
+		return nil, fmt.Errorf("readMemInfo: %w", err)
+	}
+	defer file.Close()
+
+	result := make(map[string]uint64)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		name, rest, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		fields := strings.Fields(rest)
+		if len(fields) == 0 {
+			continue
+		}
+		value, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("readMemInfo: parse %s: %w", name, err)
+		}
+		if len(fields) > 1 && fields[1] == "kB" {
+			value *= 1024
+		}
+		result[name] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("readMemInfo: %w", err)
+	}
+	return result, nil
+}
+
+// readStat returns cumulative idle and total jiffies per core from /proc/stat.
+func (c *SystemCollector) readStat() (map[int]cpuTimes, error) {
+	file, err := os.Open(filepath.Join(c.procPath, "stat"))
+	if err != nil {
+		return nil, fmt.Errorf("readStat: %w", err)
+	}
+	defer file.Close()
+
+	result := make(map[int]cpuTimes)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 || !strings.HasPrefix(fields[0], "cpu") || fields[0] == "cpu" {
+			continue
+		}
+		cpu, err := strconv.Atoi(strings.TrimPrefix(fields[0], "cpu"))
+		if err != nil {
+			return nil, fmt.Errorf("readStat: parse %s: %w", fields[0], err)
+		}
+
+		var times cpuTimes
+		for i, field := range fields[1:] {
+			value, err := strconv.ParseUint(field, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("readStat: parse %s: %w", fields[0], err)
+			}
+			// idle and iowait columns
+			if i == 3 || i == 4 {
+				times.idle += value
+			}
+			times.total += value
+		}
+		result[cpu] = times
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("readStat: %w", err)
+	}
+	return result, nil
+}
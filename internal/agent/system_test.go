@@ -0,0 +1,58 @@
+package agent_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fireflg/ago-musthave-metrics-tpl/internal/agent"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSystemCollector_Memory(t *testing.T) {
+	collector := agent.NewSystemCollector("testdata/proc")
+
+	sample, err := collector.Collect(context.Background())
+	require.NoError(t, err)
+
+	assert.Equal(t, float64(8048576*1024), sample.Gauges["TotalMemory"])
+	assert.Equal(t, float64(2024288*1024), sample.Gauges["FreeMemory"])
+}
+
+func TestSystemCollector_CPUUtilization(t *testing.T) {
+	dir := t.TempDir()
+	meminfo, err := os.ReadFile("testdata/proc/meminfo")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "meminfo"), meminfo, 0644))
+	stat, err := os.ReadFile("testdata/proc/stat")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "stat"), stat, 0644))
+
+	collector := agent.NewSystemCollector(dir)
+
+	sample, err := collector.Collect(context.Background())
+	require.NoError(t, err)
+	// The first poll has no interval to measure.
+	assert.NotContains(t, sample.Gauges, "CPUutilization1")
+	assert.NotContains(t, sample.Gauges, "CPUutilization2")
+
+	// cpu0 is busy for 50 of 100 jiffies, cpu1 idles the whole interval.
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "stat"), []byte(
+		"cpu  450 0 200 1550 0 0 0 0 0 0\n"+
+			"cpu0 150 0 50 400 0 0 0 0 0 0\n"+
+			"cpu1 300 0 150 1150 0 0 0 0 0 0\n"), 0644))
+
+	sample, err = collector.Collect(context.Background())
+	require.NoError(t, err)
+	assert.InDelta(t, 50.0, sample.Gauges["CPUutilization1"], 0.001)
+	assert.InDelta(t, 0.0, sample.Gauges["CPUutilization2"], 0.001)
+}
+
+func TestSystemCollector_MissingProc(t *testing.T) {
+	collector := agent.NewSystemCollector(t.TempDir())
+
+	_, err := collector.Collect(context.Background())
+	assert.Error(t, err)
+}
@@ -0,0 +1,228 @@
+package alerting
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	models "github.com/fireflg/ago-musthave-metrics-tpl/internal/model"
+	"github.com/fireflg/ago-musthave-metrics-tpl/internal/webhook"
+	"go.uber.org/zap"
+)
+
+// Notification is posted to the webhook with the alerts that started firing or resolved.
+type Notification struct {
+	Alerts []models.Alert `json:"alerts"`
+}
+
+// maxUnsent bounds the undelivered state changes kept while the webhook is down, the oldest are dropped first.
+const maxUnsent = 1000
+
+type sample struct {
+	value float64
+	at    time.Time
+}
+
+// Engine periodically evaluates rules against the stored metrics.
+// An alert is pending while its condition holds for less than the rule duration, then firing
+// until the condition clears or the metric disappears, at which point it is resolved.
+type Engine struct {
+	repo    models.MetricsRepository
+	rules   []Rule
+	webhook *webhook.Client
+	logger  *zap.SugaredLogger
+
+	mu      sync.Mutex
+	active  map[string]*models.Alert
+	samples map[string]sample
+	// unsent holds state changes the webhook has not accepted yet, they are resent with the next notification.
+	unsent []models.Alert
+}
+
+func NewEngine(repo models.MetricsRepository, rules []Rule, webhookURL string, logger *zap.SugaredLogger) *Engine {
+	e := &Engine{
+		repo:    repo,
+		rules:   rules,
+		logger:  logger,
+		active:  make(map[string]*models.Alert),
+		samples: make(map[string]sample),
+	}
+	if webhookURL != "" {
+		e.webhook = webhook.NewClient(webhookURL)
+	}
+	return e
+}
+
+// Run evaluates the rules every interval until ctx is cancelled.
+func (e *Engine) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := e.Evaluate(ctx, time.Now()); err != nil {
+				e.logger.Errorw("Alert evaluation failed", "error", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Evaluate checks every rule as of now and notifies the webhook about state changes.
+func (e *Engine) Evaluate(ctx context.Context, now time.Time) error {
+	metrics, err := e.repo.List(ctx)
+	if err != nil {
+		return fmt.Errorf("list metrics: %w", err)
+	}
+
+	e.mu.Lock()
+	changes := e.evaluate(metrics, now)
+	var notify []models.Alert
+	if e.webhook != nil {
+		notify = append(e.unsent, changes...)
+		e.unsent = nil
+	}
+	e.mu.Unlock()
+
+	for _, alert := range changes {
+		e.logger.Warnw("Alert "+alert.State, "rule", alert.Rule, "metric", alert.Metric, "labels", alert.Labels, "value", alert.Value)
+	}
+
+	if len(notify) == 0 {
+		return nil
+	}
+	if err := e.webhook.Post(ctx, Notification{Alerts: notify}); err != nil {
+		e.mu.Lock()
+		e.unsent = append(notify, e.unsent...)
+		if len(e.unsent) > maxUnsent {
+			e.unsent = e.unsent[len(e.unsent)-maxUnsent:]
+		}
+		e.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// evaluate updates alert states and returns the alerts that fired or resolved, e.mu must be held.
+func (e *Engine) evaluate(metrics []models.Metrics, now time.Time) []models.Alert {
+	var changes []models.Alert
+	seen := make(map[string]bool)
+
+	for i := range e.rules {
+		rule := &e.rules[i]
+		for _, metric := range metrics {
+			if !rule.matches(metric) {
+				continue
+			}
+			key := rule.Name + "/" + metric.Key()
+			seen[key] = true
+
+			value, ok := e.value(rule, key, metric, now)
+			if !ok {
+				continue
+			}
+
+			alert, active := e.active[key]
+			if !rule.compare(value) {
+				if active {
+					if alert.State == models.AlertFiring {
+						changes = append(changes, resolve(alert, now))
+					}
+					delete(e.active, key)
+				}
+				continue
+			}
+
+			if !active {
+				alert = &models.Alert{
+					Rule:        rule.Name,
+					Expr:        rule.Expr,
+					Metric:      metric.ID,
+					Labels:      metric.Labels,
+					State:       models.AlertPending,
+					ActiveSince: now,
+				}
+				e.active[key] = alert
+			}
+			alert.Value = value
+			if alert.State == models.AlertPending && now.Sub(alert.ActiveSince) >= rule.duration {
+				alert.State = models.AlertFiring
+				alert.FiredAt = now
+				changes = append(changes, *alert)
+			}
+		}
+	}
+
+	for key, alert := range e.active {
+		if seen[key] {
+			continue
+		}
+		if alert.State == models.AlertFiring {
+			changes = append(changes, resolve(alert, now))
+		}
+		delete(e.active, key)
+	}
+	for key := range e.samples {
+		if !seen[key] {
+			delete(e.samples, key)
+		}
+	}
+	return changes
+}
+
+// value returns the value the rule compares, for rate rules the change since the previous
+// evaluation. It reports false when there is no previous sample or the counter was reset.
+func (e *Engine) value(rule *Rule, key string, metric models.Metrics, now time.Time) (float64, bool) {
+	var value float64
+	switch {
+	case metric.Value != nil:
+		value = *metric.Value
+	case metric.Delta != nil:
+		value = float64(*metric.Delta)
+	default:
+		return 0, false
+	}
+	if !rule.rate {
+		return value, true
+	}
+
+	prev, ok := e.samples[key]
+	e.samples[key] = sample{value: value, at: now}
+	if !ok || value < prev.value || !now.After(prev.at) {
+		return 0, false
+	}
+	perSecond := (value - prev.value) / now.Sub(prev.at).Seconds()
+	return perSecond * rule.rateUnit.Seconds(), true
+}
+
+func resolve(alert *models.Alert, now time.Time) models.Alert {
+	resolved := *alert
+	resolved.State = models.AlertResolved
+	resolved.ResolvedAt = now
+	return resolved
+}
+
+// Alerts returns the pending and firing alerts sorted by rule and metric.
+func (e *Engine) Alerts() []models.Alert {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	result := make([]models.Alert, 0, len(e.active))
+	for _, alert := range e.active {
+		result = append(result, *alert)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Rule != result[j].Rule {
+			return result[i].Rule < result[j].Rule
+		}
+		if result[i].Metric != result[j].Metric {
+			return result[i].Metric < result[j].Metric
+		}
+		return models.LabelsKey(result[i].Labels) < models.LabelsKey(result[j].Labels)
+	})
+	return result
+}
@@ -0,0 +1,134 @@
+package alerting_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fireflg/ago-musthave-metrics-tpl/internal/alerting"
+	models "github.com/fireflg/ago-musthave-metrics-tpl/internal/model"
+	"github.com/fireflg/ago-musthave-metrics-tpl/internal/repository/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+type webhookRecorder struct {
+	mu     sync.Mutex
+	alerts []models.Alert
+	// failures is the number of next requests answered with 503.
+	failures int
+}
+
+func (rec *webhookRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rec.mu.Lock()
+	if rec.failures > 0 {
+		rec.failures--
+		rec.mu.Unlock()
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	rec.mu.Unlock()
+
+	var notification alerting.Notification
+	if err := json.NewDecoder(r.Body).Decode(&notification); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rec.mu.Lock()
+	rec.alerts = append(rec.alerts, notification.Alerts...)
+	rec.mu.Unlock()
+}
+
+func (rec *webhookRecorder) states() []string {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	states := make([]string, 0, len(rec.alerts))
+	for _, alert := range rec.alerts {
+		states = append(states, alert.State)
+	}
+	return states
+}
+
+func TestEngine_GaugeThresholdFor(t *testing.T) {
+	rec := &webhookRecorder{}
+	srv := httptest.NewServer(rec)
+	defer srv.Close()
+
+	ctx := context.Background()
+	repo := memory.NewMemoryRepository()
+	rule, err := alerting.ParseRule("heap-high", "gauge HeapAlloc > 500MB for 2m", nil)
+	require.NoError(t, err)
+	engine := alerting.NewEngine(repo, []alerting.Rule{rule}, srv.URL, zap.NewNop().Sugar())
+
+	start := time.Now()
+	require.NoError(t, repo.SetGauge(ctx, "HeapAlloc", 600<<20))
+
+	require.NoError(t, engine.Evaluate(ctx, start))
+	alerts := engine.Alerts()
+	require.Len(t, alerts, 1)
+	assert.Equal(t, models.AlertPending, alerts[0].State)
+
+	require.NoError(t, engine.Evaluate(ctx, start.Add(2*time.Minute)))
+	alerts = engine.Alerts()
+	require.Len(t, alerts, 1)
+	assert.Equal(t, models.AlertFiring, alerts[0].State)
+	assert.Equal(t, float64(600<<20), alerts[0].Value)
+
+	require.NoError(t, repo.SetGauge(ctx, "HeapAlloc", 100<<20))
+	require.NoError(t, engine.Evaluate(ctx, start.Add(3*time.Minute)))
+	assert.Empty(t, engine.Alerts())
+
+	assert.Equal(t, []string{models.AlertFiring, models.AlertResolved}, rec.states())
+}
+
+func TestEngine_ResendsUndeliveredNotifications(t *testing.T) {
+	rec := &webhookRecorder{failures: 1}
+	srv := httptest.NewServer(rec)
+	defer srv.Close()
+
+	ctx := context.Background()
+	repo := memory.NewMemoryRepository()
+	rule, err := alerting.ParseRule("heap-high", "gauge HeapAlloc > 500MB", nil)
+	require.NoError(t, err)
+	engine := alerting.NewEngine(repo, []alerting.Rule{rule}, srv.URL, zap.NewNop().Sugar())
+
+	start := time.Now()
+	require.NoError(t, repo.SetGauge(ctx, "HeapAlloc", 600<<20))
+	assert.Error(t, engine.Evaluate(ctx, start))
+	assert.Empty(t, rec.states())
+
+	require.NoError(t, engine.Evaluate(ctx, start.Add(time.Minute)))
+	assert.Equal(t, []string{models.AlertFiring}, rec.states())
+
+	require.NoError(t, repo.SetGauge(ctx, "HeapAlloc", 100<<20))
+	require.NoError(t, engine.Evaluate(ctx, start.Add(2*time.Minute)))
+	assert.Equal(t, []string{models.AlertFiring, models.AlertResolved}, rec.states())
+}
+
+func TestEngine_CounterRate(t *testing.T) {
+	ctx := context.Background()
+	repo := memory.NewMemoryRepository()
+	rule, err := alerting.ParseRule("poll-stalled", "counter PollCount rate < 1/min", nil)
+	require.NoError(t, err)
+	engine := alerting.NewEngine(repo, []alerting.Rule{rule}, "", zap.NewNop().Sugar())
+
+	start := time.Now()
+	require.NoError(t, repo.SetCounter(ctx, "PollCount", 10))
+	require.NoError(t, engine.Evaluate(ctx, start))
+	assert.Empty(t, engine.Alerts(), "rate needs two samples")
+
+	require.NoError(t, repo.SetCounter(ctx, "PollCount", 5))
+	require.NoError(t, engine.Evaluate(ctx, start.Add(time.Minute)))
+	assert.Empty(t, engine.Alerts())
+
+	require.NoError(t, engine.Evaluate(ctx, start.Add(2*time.Minute)))
+	alerts := engine.Alerts()
+	require.Len(t, alerts, 1)
+	assert.Equal(t, models.AlertFiring, alerts[0].State)
+	assert.Equal(t, 0.0, alerts[0].Value)
+}
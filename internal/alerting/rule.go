@@ -0,0 +1,205 @@
+package alerting
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	models "github.com/fireflg/ago-musthave-metrics-tpl/internal/model"
+	"gopkg.in/yaml.v3"
+)
+
+// Rule is a threshold rule written as
+//
+//	<type> <metric> [rate] <op> <threshold> [for <duration>]
+//
+// e.g. "gauge HeapAlloc > 500MB for 2m" or "counter PollCount rate < 1/min".
+// Thresholds accept KB, MB, GB and TB suffixes (powers of 1024), rate thresholds
+// are per second unless a /s, /min or /h unit is given.
+// Labels restrict the rule to metrics that carry all of them.
+type Rule struct {
+	Name   string            `json:"name" yaml:"name"`
+	Expr   string            `json:"expr" yaml:"expr"`
+	Labels map[string]string `json:"labels,omitempty" yaml:"labels,omitempty"`
+
+	metricType string
+	metric     string
+	rate       bool
+	rateUnit   time.Duration
+	op         string
+	threshold  float64
+	duration   time.Duration
+}
+
+type rulesFile struct {
+	Rules []Rule `json:"rules" yaml:"rules"`
+}
+
+// LoadRules reads rules from a YAML file, or a JSON one when path ends with .json.
+func LoadRules(path string) ([]Rule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("LoadRules: read file: %w", err)
+	}
+
+	var file rulesFile
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		err = json.Unmarshal(data, &file)
+	} else {
+		err = yaml.Unmarshal(data, &file)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("LoadRules: decode %s: %w", path, err)
+	}
+
+	names := make(map[string]bool, len(file.Rules))
+	for i := range file.Rules {
+		rule := &file.Rules[i]
+		if err := rule.parse(); err != nil {
+			return nil, fmt.Errorf("LoadRules: %w", err)
+		}
+		if names[rule.Name] {
+			return nil, fmt.Errorf("LoadRules: duplicate rule name %q", rule.Name)
+		}
+		names[rule.Name] = true
+	}
+	return file.Rules, nil
+}
+
+// ParseRule creates a rule from its expression.
+func ParseRule(name, expr string, labels map[string]string) (Rule, error) {
+	rule := Rule{Name: name, Expr: expr, Labels: labels}
+	if err := rule.parse(); err != nil {
+		return Rule{}, err
+	}
+	return rule, nil
+}
+
+func (r *Rule) parse() error {
+	if r.Name == "" {
+		return fmt.Errorf("rule %q: name is empty", r.Expr)
+	}
+
+	fields := strings.Fields(r.Expr)
+	if len(fields) < 4 {
+		return fmt.Errorf("rule %s: expected \"<type> <metric> [rate] <op> <threshold> [for <duration>]\", got %q", r.Name, r.Expr)
+	}
+
+	r.metricType, r.metric = fields[0], fields[1]
+	if r.metricType != models.Gauge && r.metricType != models.Counter {
+		return fmt.Errorf("rule %s: unknown metric type %q", r.Name, r.metricType)
+	}
+
+	rest := fields[2:]
+	if rest[0] == "rate" {
+		r.rate = true
+		rest = rest[1:]
+	}
+	if len(rest) != 2 && len(rest) != 4 {
+		return fmt.Errorf("rule %s: expected \"<op> <threshold> [for <duration>]\", got %q", r.Name, strings.Join(rest, " "))
+	}
+
+	switch rest[0] {
+	case ">", ">=", "<", "<=", "==", "!=":
+		r.op = rest[0]
+	default:
+		return fmt.Errorf("rule %s: unknown operator %q", r.Name, rest[0])
+	}
+
+	var err error
+	if r.rate {
+		r.threshold, r.rateUnit, err = parseRate(rest[1])
+	} else {
+		r.threshold, err = parseThreshold(rest[1])
+	}
+	if err != nil {
+		return fmt.Errorf("rule %s: %w", r.Name, err)
+	}
+
+	if len(rest) == 4 {
+		if rest[2] != "for" {
+			return fmt.Errorf("rule %s: expected \"for\", got %q", r.Name, rest[2])
+		}
+		if r.duration, err = time.ParseDuration(rest[3]); err != nil || r.duration < 0 {
+			return fmt.Errorf("rule %s: invalid duration %q", r.Name, rest[3])
+		}
+	}
+	return nil
+}
+
+// matches reports whether the rule applies to metric.
+func (r *Rule) matches(metric models.Metrics) bool {
+	return metric.ID == r.metric && metric.MType == r.metricType && metric.HasLabels(r.Labels)
+}
+
+func (r *Rule) compare(value float64) bool {
+	switch r.op {
+	case ">":
+		return value > r.threshold
+	case ">=":
+		return value >= r.threshold
+	case "<":
+		return value < r.threshold
+	case "<=":
+		return value <= r.threshold
+	case "==":
+		return value == r.threshold
+	default:
+		return value != r.threshold
+	}
+}
+
+var sizeSuffixes = []struct {
+	suffix string
+	factor float64
+}{
+	{"TB", 1 << 40},
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+}
+
+func parseThreshold(value string) (float64, error) {
+	factor := 1.0
+	for _, s := range sizeSuffixes {
+		if strings.HasSuffix(strings.ToUpper(value), s.suffix) {
+			value, factor = value[:len(value)-len(s.suffix)], s.factor
+			break
+		}
+	}
+
+	threshold, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid threshold %q", value)
+	}
+	return threshold * factor, nil
+}
+
+func parseRate(value string) (float64, time.Duration, error) {
+	number, unit, ok := strings.Cut(value, "/")
+	if !ok {
+		unit = "s"
+	}
+
+	var per time.Duration
+	switch unit {
+	case "s", "sec":
+		per = time.Second
+	case "m", "min":
+		per = time.Minute
+	case "h":
+		per = time.Hour
+	default:
+		return 0, 0, fmt.Errorf("unknown rate unit %q", unit)
+	}
+
+	threshold, err := parseThreshold(number)
+	if err != nil {
+		return 0, 0, err
+	}
+	return threshold, per, nil
+}
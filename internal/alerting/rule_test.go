@@ -0,0 +1,68 @@
+package alerting_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fireflg/ago-musthave-metrics-tpl/internal/alerting"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRule(t *testing.T) {
+	valid := []string{
+		"gauge HeapAlloc > 500MB for 2m",
+		"counter PollCount rate < 1/min",
+		"gauge CPUutilization1 >= 90",
+		"counter PollCount != 0 for 30s",
+	}
+	for _, expr := range valid {
+		_, err := alerting.ParseRule("rule", expr, nil)
+		assert.NoError(t, err, expr)
+	}
+
+	invalid := []string{
+		"",
+		"histogram Latency > 1",
+		"gauge HeapAlloc ~ 1",
+		"gauge HeapAlloc > lots",
+		"gauge HeapAlloc > 1 during 2m",
+		"gauge HeapAlloc > 1 for soon",
+		"counter PollCount rate < 1/week",
+	}
+	for _, expr := range invalid {
+		_, err := alerting.ParseRule("rule", expr, nil)
+		assert.Error(t, err, expr)
+	}
+}
+
+func TestLoadRules(t *testing.T) {
+	dir := t.TempDir()
+
+	yamlPath := filepath.Join(dir, "rules.yaml")
+	require.NoError(t, os.WriteFile(yamlPath, []byte(`
+rules:
+  - name: heap-high
+    expr: gauge HeapAlloc > 500MB for 2m
+    labels:
+      host: a
+  - name: poll-stalled
+    expr: counter PollCount rate < 1/min
+`), 0644))
+	rules, err := alerting.LoadRules(yamlPath)
+	require.NoError(t, err)
+	require.Len(t, rules, 2)
+	assert.Equal(t, "heap-high", rules[0].Name)
+	assert.Equal(t, map[string]string{"host": "a"}, rules[0].Labels)
+
+	jsonPath := filepath.Join(dir, "rules.json")
+	require.NoError(t, os.WriteFile(jsonPath, []byte(`{"rules": [{"name": "heap-high", "expr": "gauge HeapAlloc > 1"}]}`), 0644))
+	rules, err = alerting.LoadRules(jsonPath)
+	require.NoError(t, err)
+	require.Len(t, rules, 1)
+
+	require.NoError(t, os.WriteFile(jsonPath, []byte(`{"rules": [{"name": "a", "expr": "gauge X > 1"}, {"name": "a", "expr": "gauge Y > 1"}]}`), 0644))
+	_, err = alerting.LoadRules(jsonPath)
+	assert.Error(t, err)
+}
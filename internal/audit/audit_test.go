@@ -0,0 +1,86 @@
+package audit_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fireflg/ago-musthave-metrics-tpl/internal/audit"
+	models "github.com/fireflg/ago-musthave-metrics-tpl/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	sink, err := audit.NewFileSink(path, zap.NewNop().Sugar())
+	require.NoError(t, err)
+
+	sink.Notify(models.AuditEvent{TS: 1, Metrics: []string{"Alloc"}, IPAddress: "10.0.0.1"})
+	sink.Notify(models.AuditEvent{TS: 2, Metrics: []string{"PollCount", "Alloc"}, IPAddress: "10.0.0.2"})
+	require.NoError(t, sink.Close())
+
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+
+	var events []models.AuditEvent
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var event models.AuditEvent
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &event))
+		events = append(events, event)
+	}
+	require.NoError(t, scanner.Err())
+
+	require.Len(t, events, 2)
+	assert.Equal(t, int64(2), events[1].TS)
+	assert.Equal(t, []string{"PollCount", "Alloc"}, events[1].Metrics)
+	assert.Equal(t, "10.0.0.2", events[1].IPAddress)
+}
+
+func TestHTTPSink(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		received []models.AuditEvent
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event models.AuditEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		received = append(received, event)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	sink := audit.NewHTTPSink(srv.URL, zap.NewNop().Sugar())
+	sink.Notify(models.AuditEvent{TS: 1, Metrics: []string{"Alloc"}, IPAddress: "10.0.0.1"})
+	sink.Notify(models.AuditEvent{TS: 2, Metrics: []string{"PollCount"}, IPAddress: "10.0.0.1"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, sink.Close(ctx))
+
+	// Updates can still be accepted while the server shuts down.
+	assert.NotPanics(t, func() {
+		sink.Notify(models.AuditEvent{TS: 3, Metrics: []string{"Late"}, IPAddress: "10.0.0.1"})
+	})
+	require.NoError(t, sink.Close(ctx))
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, received, 2)
+	assert.Equal(t, []string{"Alloc"}, received[0].Metrics)
+	assert.Equal(t, []string{"PollCount"}, received[1].Metrics)
+}
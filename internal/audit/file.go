@@ -0,0 +1,47 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	models "github.com/fireflg/ago-musthave-metrics-tpl/internal/model"
+	"go.uber.org/zap"
+)
+
+// FileSink appends audit events to a file, one JSON object per line.
+type FileSink struct {
+	mu     sync.Mutex
+	file   *os.File
+	logger *zap.SugaredLogger
+}
+
+func NewFileSink(path string, logger *zap.SugaredLogger) (*FileSink, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("audit: open file: %w", err)
+	}
+	return &FileSink{file: file, logger: logger}, nil
+}
+
+func (s *FileSink) Notify(event models.AuditEvent) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		s.logger.Errorw("Failed to encode audit event", "error", err)
+		return
+	}
+	data = append(data, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.file.Write(data); err != nil {
+		s.logger.Errorw("Failed to write audit event", "path", s.file.Name(), "error", err)
+	}
+}
+
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
@@ -0,0 +1,75 @@
+package audit
+
+import (
+	"context"
+	"sync"
+
+	models "github.com/fireflg/ago-musthave-metrics-tpl/internal/model"
+	"github.com/fireflg/ago-musthave-metrics-tpl/internal/webhook"
+	"go.uber.org/zap"
+)
+
+// queueSize bounds the events waiting to be posted, further events are dropped.
+const queueSize = 1024
+
+// HTTPSink posts audit events to a URL from a background worker so that
+// a slow receiver does not delay updates.
+type HTTPSink struct {
+	client *webhook.Client
+	logger *zap.SugaredLogger
+	events chan models.AuditEvent
+	done   chan struct{}
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func NewHTTPSink(url string, logger *zap.SugaredLogger) *HTTPSink {
+	s := &HTTPSink{
+		client: webhook.NewClient(url),
+		logger: logger,
+		events: make(chan models.AuditEvent, queueSize),
+		done:   make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+// Notify queues the event, events arriving after Close are dropped.
+func (s *HTTPSink) Notify(event models.AuditEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.events <- event:
+	default:
+		s.logger.Warnw("Audit queue is full, dropping event", "metrics", event.Metrics)
+	}
+}
+
+func (s *HTTPSink) run() {
+	defer close(s.done)
+	for event := range s.events {
+		if err := s.client.Post(context.Background(), event); err != nil {
+			s.logger.Errorw("Failed to send audit event", "error", err)
+		}
+	}
+}
+
+// Close stops accepting events and waits until the queued ones are sent or ctx is done.
+func (s *HTTPSink) Close(ctx context.Context) error {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.events)
+	}
+	s.mu.Unlock()
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -4,14 +4,33 @@ import (
 	"flag"
 	"fmt"
 	"github.com/caarlos0/env"
+	"net"
 )
 
 type Config struct {
 	RunAddr                   string `env:"ADDRESS" envDefault:":8080"`
+	GRPCAddr                  string `env:"GRPC_ADDRESS" envDefault:""`
 	PersistentStorageInterval int    `env:"STORAGE_INTERVAL" envDefault:"0"`
 	PersistentStoragePath     string `env:"FILE_STORAGE_PATH" envDefault:"metrics.json"`
 	PersistentStorageRestore  bool   `env:"RESTORE" envDefault:"false"`
+	PersistentStorageBackups  int    `env:"FILE_STORAGE_BACKUPS" envDefault:"3"`
+	PersistentStorageWAL      bool   `env:"FILE_STORAGE_WAL" envDefault:"false"`
+	WALCompactRecords         int    `env:"WAL_COMPACT_RECORDS" envDefault:"10000"`
 	DatabaseDSN               string `env:"DATABASE_DSN" envDefault:""`
+	Key                       string `env:"KEY" envDefault:""`
+	CryptoKey                 string `env:"CRYPTO_KEY" envDefault:""`
+	TrustedSubnet             string `env:"TRUSTED_SUBNET" envDefault:""`
+	HistoryEnabled            bool   `env:"HISTORY" envDefault:"false"`
+	HistorySize               int    `env:"HISTORY_SIZE" envDefault:"1000"`
+	MigrateOnly               bool   `env:"MIGRATE_ONLY" envDefault:"false"`
+	MigrateDown               int    `env:"MIGRATE_DOWN" envDefault:"0"`
+	StaleTTL                  int    `env:"STALE_TTL" envDefault:"0"`
+	StaleWebhook              string `env:"STALE_WEBHOOK" envDefault:""`
+	AlertRules                string `env:"ALERT_RULES" envDefault:""`
+	AlertWebhook              string `env:"ALERT_WEBHOOK" envDefault:""`
+	AlertInterval             int    `env:"ALERT_INTERVAL" envDefault:"15"`
+	AuditFile                 string `env:"AUDIT_FILE" envDefault:""`
+	AuditURL                  string `env:"AUDIT_URL" envDefault:""`
 	StorageMode               string
 }
 
@@ -24,16 +43,56 @@ func LoadAServerConfig() (*Config, error) {
 	}
 
 	flag.StringVar(&cfg.RunAddr, "a", cfg.RunAddr, "Address and port to run server")
+	flag.StringVar(&cfg.GRPCAddr, "g", cfg.GRPCAddr, "Address and port to serve gRPC on (empty = gRPC disabled)")
 	flag.StringVar(&cfg.PersistentStoragePath, "f", cfg.PersistentStoragePath, "Path to store metrics")
 	flag.IntVar(&cfg.PersistentStorageInterval, "i", cfg.PersistentStorageInterval, "Interval to store metrics in seconds (0 = sync save)")
 	flag.BoolVar(&cfg.PersistentStorageRestore, "r", cfg.PersistentStorageRestore, "Whether to restore metrics")
+	flag.IntVar(&cfg.PersistentStorageBackups, "backups", cfg.PersistentStorageBackups, "Number of previous snapshots to keep next to the storage file")
+	flag.BoolVar(&cfg.PersistentStorageWAL, "wal", cfg.PersistentStorageWAL, "Append updates to a write-ahead log instead of rewriting the storage file")
+	flag.IntVar(&cfg.WALCompactRecords, "wal-compact", cfg.WALCompactRecords, "Number of write-ahead log records after which the log is compacted into the storage file")
 	flag.StringVar(&cfg.DatabaseDSN, "d", cfg.DatabaseDSN, "Database connection string")
+	flag.BoolVar(&cfg.HistoryEnabled, "history", cfg.HistoryEnabled, "Record every metric update with a timestamp")
+	flag.IntVar(&cfg.HistorySize, "history-size", cfg.HistorySize, "Number of history points kept per metric, 0 disables history")
+	flag.BoolVar(&cfg.MigrateOnly, "migrate-only", cfg.MigrateOnly, "Apply database migrations and exit")
+	flag.IntVar(&cfg.MigrateDown, "migrate-down", cfg.MigrateDown, "Roll back the given number of database migrations and exit")
+	flag.IntVar(&cfg.StaleTTL, "stale-ttl", cfg.StaleTTL, "Seconds without updates after which metrics and agents are stale (0 = disabled)")
+	flag.StringVar(&cfg.StaleWebhook, "stale-webhook", cfg.StaleWebhook, "URL to POST newly stale metrics and agents to")
+	flag.StringVar(&cfg.AlertRules, "alert-rules", cfg.AlertRules, "Path to a YAML or JSON file with alerting rules (empty = alerting disabled)")
+	flag.StringVar(&cfg.AlertWebhook, "alert-webhook", cfg.AlertWebhook, "URL to POST firing and resolved alerts to")
+	flag.IntVar(&cfg.AlertInterval, "alert-interval", cfg.AlertInterval, "Interval to evaluate alerting rules in seconds")
+	flag.StringVar(&cfg.AuditFile, "audit-file", cfg.AuditFile, "Path to append audit events to as JSON lines (empty = disabled)")
+	flag.StringVar(&cfg.AuditURL, "audit-url", cfg.AuditURL, "URL to POST audit events to (empty = disabled)")
+	flag.StringVar(&cfg.Key, "k", cfg.Key, "Key to sign and verify request bodies (HMAC-SHA256)")
+	flag.StringVar(&cfg.TrustedSubnet, "t", cfg.TrustedSubnet, "CIDR that update requests must come from, checked against X-Real-IP (empty = any)")
+	flag.StringVar(&cfg.CryptoKey, "crypto-key", cfg.CryptoKey, "Path to the RSA private key used to decrypt update bodies")
 	flag.Parse()
 
 	if unknownFlags := flag.Args(); len(unknownFlags) > 0 {
 		return nil, fmt.Errorf("invalid flags: %v", unknownFlags)
 	}
 
+	if cfg.TrustedSubnet != "" {
+		if _, _, err := net.ParseCIDR(cfg.TrustedSubnet); err != nil {
+			return nil, fmt.Errorf("invalid trusted subnet: %w", err)
+		}
+	}
+
+	if cfg.PersistentStorageBackups < 0 {
+		return nil, fmt.Errorf("storage backups must not be negative, got %d", cfg.PersistentStorageBackups)
+	}
+
+	if cfg.HistorySize < 0 {
+		return nil, fmt.Errorf("history size must not be negative, got %d", cfg.HistorySize)
+	}
+
+	if cfg.WALCompactRecords < 1 {
+		return nil, fmt.Errorf("WAL compaction threshold must be positive, got %d", cfg.WALCompactRecords)
+	}
+
+	if cfg.AlertInterval < 1 {
+		return nil, fmt.Errorf("alert interval must be positive, got %d", cfg.AlertInterval)
+	}
+
 	switch {
 	case cfg.DatabaseDSN != "":
 		cfg.StorageMode = "db"
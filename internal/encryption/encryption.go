@@ -0,0 +1,149 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Messages are encrypted with a random AES-256-GCM session key, which is itself encrypted
+// with RSA-OAEP (SHA-256). The encrypted message is laid out as
+//
+//	[2 bytes encrypted key length][encrypted key][12 bytes nonce][AES-GCM ciphertext]
+const sessionKeySize = 32
+
+var ErrMalformed = errors.New("malformed encrypted message")
+
+// LoadPublicKey reads a PEM encoded RSA public key in PKIX or PKCS#1 form.
+func LoadPublicKey(path string) (*rsa.PublicKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if key, err := x509.ParsePKCS1PublicKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("LoadPublicKey: parse %s: %w", path, err)
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("LoadPublicKey: %s is not an RSA key", path)
+	}
+	return rsaKey, nil
+}
+
+// LoadPrivateKey reads a PEM encoded RSA private key in PKCS#1 or PKCS#8 form.
+func LoadPrivateKey(path string) (*rsa.PrivateKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("LoadPrivateKey: parse %s: %w", path, err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("LoadPrivateKey: %s is not an RSA key", path)
+	}
+	return rsaKey, nil
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("read key: %s is not PEM encoded", path)
+	}
+	return block, nil
+}
+
+// Encrypt encrypts plaintext for the owner of key.
+func Encrypt(key *rsa.PublicKey, plaintext []byte) ([]byte, error) {
+	sessionKey := make([]byte, sessionKeySize)
+	if _, err := rand.Read(sessionKey); err != nil {
+		return nil, fmt.Errorf("Encrypt: session key: %w", err)
+	}
+
+	encryptedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, key, sessionKey, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Encrypt: encrypt session key: %w", err)
+	}
+
+	gcm, err := newGCM(sessionKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("Encrypt: nonce: %w", err)
+	}
+
+	out := make([]byte, 2, 2+len(encryptedKey)+len(nonce)+len(plaintext)+gcm.Overhead())
+	binary.BigEndian.PutUint16(out, uint16(len(encryptedKey)))
+	out = append(out, encryptedKey...)
+	out = append(out, nonce...)
+	return gcm.Seal(out, nonce, plaintext, nil), nil
+}
+
+// Decrypt reverses Encrypt, tampered or truncated messages are rejected.
+func Decrypt(key *rsa.PrivateKey, data []byte) ([]byte, error) {
+	if len(data) < 2 {
+		return nil, ErrMalformed
+	}
+	keyLen := int(binary.BigEndian.Uint16(data))
+	data = data[2:]
+	if len(data) < keyLen {
+		return nil, ErrMalformed
+	}
+
+	sessionKey, err := rsa.DecryptOAEP(sha256.New(), nil, key, data[:keyLen], nil)
+	if err != nil {
+		return nil, fmt.Errorf("Decrypt: session key: %w", err)
+	}
+	data = data[keyLen:]
+
+	gcm, err := newGCM(sessionKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, ErrMalformed
+	}
+
+	plaintext, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("Decrypt: %w", err)
+	}
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("aes: %w", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("gcm: %w", err)
+	}
+	return gcm, nil
+}
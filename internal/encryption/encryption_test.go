@@ -0,0 +1,82 @@
+package encryption_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fireflg/ago-musthave-metrics-tpl/internal/encryption"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryptDecrypt(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	// Larger than a single RSA block to exercise the session key.
+	plaintext := bytes.Repeat([]byte("metrics"), 10000)
+	encrypted, err := encryption.Encrypt(&key.PublicKey, plaintext)
+	require.NoError(t, err)
+	assert.NotContains(t, string(encrypted), "metrics")
+
+	decrypted, err := encryption.Decrypt(key, encrypted)
+	require.NoError(t, err)
+	assert.Equal(t, plaintext, decrypted)
+
+	tampered := bytes.Clone(encrypted)
+	tampered[len(tampered)-1] ^= 0xff
+	_, err = encryption.Decrypt(key, tampered)
+	assert.Error(t, err)
+
+	_, err = encryption.Decrypt(key, encrypted[:10])
+	assert.Error(t, err)
+
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	_, err = encryption.Decrypt(other, encrypted)
+	assert.Error(t, err)
+}
+
+func TestLoadKeys(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	dir := t.TempDir()
+
+	writePEM := func(name, blockType string, der []byte) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600))
+		return path
+	}
+
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	pkix, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+
+	for _, path := range []string{
+		writePEM("pkcs1.pem", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key)),
+		writePEM("pkcs8.pem", "PRIVATE KEY", pkcs8),
+	} {
+		loaded, err := encryption.LoadPrivateKey(path)
+		require.NoError(t, err, path)
+		assert.True(t, key.Equal(loaded))
+	}
+
+	for _, path := range []string{
+		writePEM("pkcs1.pub", "RSA PUBLIC KEY", x509.MarshalPKCS1PublicKey(&key.PublicKey)),
+		writePEM("pkix.pub", "PUBLIC KEY", pkix),
+	} {
+		loaded, err := encryption.LoadPublicKey(path)
+		require.NoError(t, err, path)
+		assert.True(t, key.PublicKey.Equal(loaded))
+	}
+
+	_, err = encryption.LoadPublicKey(filepath.Join(dir, "missing.pem"))
+	assert.Error(t, err)
+}
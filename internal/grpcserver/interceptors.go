@@ -0,0 +1,76 @@
+package grpcserver
+
+import (
+	"context"
+	"net"
+	"time"
+
+	pb "github.com/fireflg/ago-musthave-metrics-tpl/internal/proto"
+	"github.com/fireflg/ago-musthave-metrics-tpl/internal/sign"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// WithLogging logs every unary call with its duration and status code.
+func WithLogging(logger *zap.SugaredLogger) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		logger.Infow("gRPC request",
+			"method", info.FullMethod,
+			"code", status.Code(err).String(),
+			"duration", time.Since(start),
+		)
+		return resp, err
+	}
+}
+
+// WithTrustedSubnet rejects UpdateMetrics calls whose x-real-ip metadata is missing or
+// outside subnet, a nil subnet accepts every call.
+func WithTrustedSubnet(subnet *net.IPNet) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if subnet == nil || info.FullMethod != pb.Metrics_UpdateMetrics_FullMethodName {
+			return handler(ctx, req)
+		}
+
+		md, _ := metadata.FromIncomingContext(ctx)
+		ip := net.ParseIP(first(md.Get(pb.RealIPKey)))
+		if ip == nil || !subnet.Contains(ip) {
+			return nil, status.Error(codes.PermissionDenied, "address is not in the trusted subnet")
+		}
+		return handler(ctx, req)
+	}
+}
+
+// WithHash verifies the HMAC-SHA256 of UpdateMetrics requests, an empty key disables the check.
+// The signature covers the deterministic protobuf encoding of the request.
+func WithHash(key string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if key == "" || info.FullMethod != pb.Metrics_UpdateMetrics_FullMethodName {
+			return handler(ctx, req)
+		}
+
+		md, _ := metadata.FromIncomingContext(ctx)
+		signature := first(md.Get(pb.HashKey))
+		if signature == "" {
+			return nil, status.Error(codes.Unauthenticated, "missing signature")
+		}
+
+		msg, ok := req.(proto.Message)
+		if !ok {
+			return nil, status.Error(codes.Internal, "unexpected request type")
+		}
+		data, err := proto.MarshalOptions{Deterministic: true}.Marshal(msg)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		if !sign.Verify(data, key, signature) {
+			return nil, status.Error(codes.Unauthenticated, "invalid signature")
+		}
+		return handler(ctx, req)
+	}
+}
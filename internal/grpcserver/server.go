@@ -0,0 +1,111 @@
+package grpcserver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	models "github.com/fireflg/ago-musthave-metrics-tpl/internal/model"
+	pb "github.com/fireflg/ago-musthave-metrics-tpl/internal/proto"
+	"github.com/fireflg/ago-musthave-metrics-tpl/internal/service"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Server implements the Metrics gRPC service on top of service.MetricsService.
+type Server struct {
+	pb.UnimplementedMetricsServer
+	service service.MetricsService
+}
+
+func NewServer(svc service.MetricsService) *Server {
+	return &Server{service: svc}
+}
+
+func (s *Server) UpdateMetrics(ctx context.Context, req *pb.UpdateMetricsRequest) (*pb.UpdateMetricsResponse, error) {
+	metrics := make([]models.Metrics, 0, len(req.GetMetrics()))
+	for _, metric := range req.GetMetrics() {
+		m := metric.ToModel()
+		if err := m.Validate(); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		metrics = append(metrics, m)
+	}
+
+	agent := agentInfo(ctx)
+	if err := s.service.SetMetricBatch(service.WithRemoteIP(ctx, agent.RemoteAddr), metrics); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	s.service.RecordAgent(agent)
+	return &pb.UpdateMetricsResponse{}, nil
+}
+
+func (s *Server) GetMetric(ctx context.Context, req *pb.GetMetricRequest) (*pb.GetMetricResponse, error) {
+	metricType := req.GetType().ModelType()
+	if metricType == "" {
+		return nil, status.Error(codes.InvalidArgument, "metric type is required")
+	}
+
+	metric, err := s.service.GetLabeledMetric(metricType, req.GetId(), req.GetLabels())
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	result, err := pb.FromModel(metric)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &pb.GetMetricResponse{Metric: result}, nil
+}
+
+func (s *Server) ListMetrics(ctx context.Context, req *pb.ListMetricsRequest) (*pb.ListMetricsResponse, error) {
+	metrics, err := s.service.ListMetrics(req.GetType().ModelType(), req.GetPrefix(), req.GetLabels())
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	resp := &pb.ListMetricsResponse{Metrics: make([]*pb.Metric, 0, len(metrics))}
+	for _, metric := range metrics {
+		m, err := pb.FromModel(metric)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		resp.Metrics = append(resp.Metrics, m)
+	}
+	return resp, nil
+}
+
+// agentInfo describes the agent identified by the request metadata, the address
+// stamped into x-real-ip is preferred over the peer address.
+func agentInfo(ctx context.Context) models.AgentInfo {
+	md, _ := metadata.FromIncomingContext(ctx)
+	agent := models.AgentInfo{
+		ID:         first(md.Get(pb.AgentIDKey)),
+		Version:    first(md.Get(pb.AgentVersionKey)),
+		RemoteAddr: first(md.Get(pb.RealIPKey)),
+		LastSeen:   time.Now(),
+	}
+	if p, ok := peer.FromContext(ctx); ok && agent.RemoteAddr == "" {
+		agent.RemoteAddr = p.Addr.String()
+		if host, _, err := net.SplitHostPort(agent.RemoteAddr); err == nil {
+			agent.RemoteAddr = host
+		}
+	}
+	return agent
+}
+
+func first(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+func toStatus(err error) error {
+	if errors.Is(err, models.ErrMetricNotFound) {
+		return status.Error(codes.NotFound, err.Error())
+	}
+	return status.Error(codes.InvalidArgument, err.Error())
+}
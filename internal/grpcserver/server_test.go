@@ -0,0 +1,124 @@
+package grpcserver_test
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/fireflg/ago-musthave-metrics-tpl/internal/agent"
+	"github.com/fireflg/ago-musthave-metrics-tpl/internal/grpcserver"
+	models "github.com/fireflg/ago-musthave-metrics-tpl/internal/model"
+	pb "github.com/fireflg/ago-musthave-metrics-tpl/internal/proto"
+	"github.com/fireflg/ago-musthave-metrics-tpl/internal/repository/memory"
+	"github.com/fireflg/ago-musthave-metrics-tpl/internal/service"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+func startServer(t *testing.T, key string) (service.MetricsService, string) {
+	return startServerWithSubnet(t, key, nil)
+}
+
+func startServerWithSubnet(t *testing.T, key string, subnet *net.IPNet) (service.MetricsService, string) {
+	svc := service.NewMetricsService(memory.NewMemoryRepository())
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := grpc.NewServer(grpc.ChainUnaryInterceptor(
+		grpcserver.WithLogging(zap.NewNop().Sugar()),
+		grpcserver.WithTrustedSubnet(subnet),
+		grpcserver.WithHash(key),
+	))
+	pb.RegisterMetricsServer(srv, grpcserver.NewServer(svc))
+	go srv.Serve(listener)
+	t.Cleanup(srv.Stop)
+
+	return svc, listener.Addr().String()
+}
+
+func TestServer_ReporterRoundTrip(t *testing.T) {
+	svc, addr := startServer(t, "secret")
+	ctx := context.Background()
+
+	reporter, err := agent.NewGRPCReporter(addr, "secret", "agent-1")
+	require.NoError(t, err)
+	defer reporter.Close()
+	require.NoError(t, reporter.WaitServer(ctx))
+
+	delta := int64(3)
+	value := 1.5
+	require.NoError(t, reporter.Report(ctx, []models.Metrics{
+		{ID: "PollCount", MType: models.Counter, Delta: &delta},
+		{ID: "Alloc", MType: models.Gauge, Value: &value, Labels: map[string]string{"host": "a"}},
+	}))
+
+	metric, err := svc.GetMetric(models.Counter, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), *metric.Delta)
+
+	agents := svc.ListAgents()
+	require.Len(t, agents, 1)
+	assert.Equal(t, "agent-1", agents[0].ID)
+	assert.Equal(t, "127.0.0.1", agents[0].RemoteAddr)
+
+	unsigned, err := agent.NewGRPCReporter(addr, "", "agent-2")
+	require.NoError(t, err)
+	defer unsigned.Close()
+	err = unsigned.Report(ctx, []models.Metrics{{ID: "PollCount", MType: models.Counter, Delta: &delta}})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+func TestServer_GetAndList(t *testing.T) {
+	svc, addr := startServer(t, "")
+	ctx := context.Background()
+
+	value := 2.5
+	require.NoError(t, svc.SetMetric(context.Background(), models.Metrics{ID: "HeapAlloc", MType: models.Gauge, Value: &value}))
+
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+	client := pb.NewMetricsClient(conn)
+
+	got, err := client.GetMetric(ctx, &pb.GetMetricRequest{Id: "HeapAlloc", Type: pb.Metric_GAUGE})
+	require.NoError(t, err)
+	assert.Equal(t, 2.5, got.GetMetric().GetValue())
+
+	_, err = client.GetMetric(ctx, &pb.GetMetricRequest{Id: "missing", Type: pb.Metric_GAUGE})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	list, err := client.ListMetrics(ctx, &pb.ListMetricsRequest{Prefix: "Heap"})
+	require.NoError(t, err)
+	require.Len(t, list.GetMetrics(), 1)
+	assert.Equal(t, "HeapAlloc", list.GetMetrics()[0].GetId())
+
+	_, err = client.UpdateMetrics(ctx, &pb.UpdateMetricsRequest{Metrics: []*pb.Metric{{Id: "x"}}})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestServer_TrustedSubnet(t *testing.T) {
+	ctx := context.Background()
+	delta := int64(1)
+	metrics := []models.Metrics{{ID: "PollCount", MType: models.Counter, Delta: &delta}}
+
+	_, loopback, err := net.ParseCIDR("127.0.0.0/8")
+	require.NoError(t, err)
+	_, addr := startServerWithSubnet(t, "", loopback)
+	reporter, err := agent.NewGRPCReporter(addr, "", "agent-1")
+	require.NoError(t, err)
+	defer reporter.Close()
+	assert.NoError(t, reporter.Report(ctx, metrics))
+
+	_, other, err := net.ParseCIDR("10.0.0.0/8")
+	require.NoError(t, err)
+	_, addr = startServerWithSubnet(t, "", other)
+	denied, err := agent.NewGRPCReporter(addr, "", "agent-1")
+	require.NoError(t, err)
+	defer denied.Close()
+	assert.Equal(t, codes.PermissionDenied, status.Code(denied.Report(ctx, metrics)))
+}
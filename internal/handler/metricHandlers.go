@@ -1,51 +1,96 @@
 package handler
 
 import (
+	"context"
+	"crypto/rsa"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/fireflg/ago-musthave-metrics-tpl/internal/alerting"
 	"github.com/fireflg/ago-musthave-metrics-tpl/internal/middleware"
 	models "github.com/fireflg/ago-musthave-metrics-tpl/internal/model"
 	"go.uber.org/zap"
+	"html/template"
 	"io"
+	"net"
 	"net/http"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/fireflg/ago-musthave-metrics-tpl/internal/service"
 	"github.com/go-chi/chi/v5"
 )
 
 type MetricsHandler struct {
-	service service.MetricsService
-	logger  *zap.SugaredLogger
+	service   service.MetricsService
+	logger    *zap.SugaredLogger
+	hashKey   string
+	stats     *middleware.RequestStats
+	stale     *service.StaleChecker
+	alerts    *alerting.Engine
+	cryptoKey *rsa.PrivateKey
+	trusted   *net.IPNet
 }
 
 func (h *MetricsHandler) ServerRouter() chi.Router {
 	r := chi.NewRouter()
-	r.Use(middleware.WithLogging(h.logger))
+	r.Use(middleware.WithLogging(h.logger, h.stats))
 
-	r.Get("/", middleware.GzipMiddleware(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "text/html")
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("<br>hi<br>"))
-	}))
+	r.Get("/", middleware.GzipMiddleware(h.ListMetricsHTML))
+	r.Get("/values/", middleware.GzipMiddleware(h.ListMetricsJSON))
 	r.Get("/value/{metricType}/{metricName}", h.GetMetric)
-	r.Post("/update/{metricType}/{metricName}/{metricValue}", h.UpdateMetric)
-	r.Post("/update/", middleware.GzipMiddleware(h.UpdateMetricJSON))
-	r.Post("/updates/", middleware.GzipMiddleware(h.UpdateMetricJSONBatch))
+	r.Group(func(r chi.Router) {
+		r.Use(middleware.WithTrustedSubnet(h.trusted))
+		r.Post("/update/{metricType}/{metricName}/{metricValue}", h.UpdateMetric)
+		r.With(middleware.WithHash(h.hashKey), middleware.WithDecrypt(h.cryptoKey)).Post("/update/", middleware.GzipMiddleware(h.UpdateMetricJSON))
+		r.With(middleware.WithHash(h.hashKey), middleware.WithDecrypt(h.cryptoKey)).Post("/updates/", middleware.GzipMiddleware(h.UpdateMetricJSONBatch))
+		r.With(middleware.WithHash(h.hashKey)).Delete("/value/{metricType}/{metricName}", h.DeleteMetric)
+		r.With(middleware.WithHash(h.hashKey)).Delete("/values/", middleware.GzipMiddleware(h.DeleteMetricJSONBatch))
+		r.With(middleware.WithHash(h.hashKey)).Post("/reset/{metricName}", h.ResetCounter)
+	})
 	r.Post("/value/", middleware.GzipMiddleware(h.GetMetricJSON))
+	r.Get("/history/{metricType}/{metricName}", middleware.GzipMiddleware(h.GetHistory))
 	r.Get("/ping", h.CheckDB)
+	r.Get("/metrics", middleware.GzipMiddleware(h.PrometheusMetrics))
+	r.Get("/agents", middleware.GzipMiddleware(h.ListAgents))
+	r.Get("/stale", middleware.GzipMiddleware(h.ListStale))
+	r.Get("/alerts", middleware.GzipMiddleware(h.ListAlerts))
 
 	return r
 }
 
-func NewMetricsHandler(service service.MetricsService, logger *zap.SugaredLogger) *MetricsHandler {
-	return &MetricsHandler{service: service, logger: logger}
+// NewMetricsHandler creates the HTTP handlers, stale and alerts may be nil when
+// stale detection or alerting are disabled, cryptoKey when update bodies are not encrypted
+// and trusted when updates are accepted from any address.
+func NewMetricsHandler(svc service.MetricsService, logger *zap.SugaredLogger, hashKey string, stale *service.StaleChecker, alerts *alerting.Engine, cryptoKey *rsa.PrivateKey, trusted *net.IPNet) *MetricsHandler {
+	return &MetricsHandler{
+		service:   svc,
+		logger:    logger,
+		hashKey:   hashKey,
+		stats:     middleware.NewRequestStats(),
+		stale:     stale,
+		alerts:    alerts,
+		cryptoKey: cryptoKey,
+		trusted:   trusted,
+	}
 }
 
 func (h *MetricsHandler) GetMetric(w http.ResponseWriter, r *http.Request) {
 	var strValue string
 
-	value, err := h.service.GetMetric(chi.URLParam(r, "metricType"), chi.URLParam(r, "metricName"))
+	labels, err := parseLabels(r.URL.Query()["label"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	value, err := h.service.GetLabeledMetric(chi.URLParam(r, "metricType"), chi.URLParam(r, "metricName"), labels)
+	if errors.Is(err, models.ErrAmbiguousMetric) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
@@ -97,7 +142,7 @@ func (h *MetricsHandler) UpdateMetric(w http.ResponseWriter, r *http.Request) {
 		}
 		metric.Delta = &intValue
 	}
-	if err := h.service.SetMetric(metric); err != nil {
+	if err := h.service.SetMetric(updateContext(r), metric); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
@@ -113,12 +158,15 @@ func (h *MetricsHandler) UpdateMetricJSON(w http.ResponseWriter, r *http.Request
 
 	if err := json.NewDecoder(r.Body).Decode(&metric); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
+		return
 	}
 
-	err := h.service.SetMetric(metric)
+	err := h.service.SetMetric(updateContext(r), metric)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
+	h.trackAgent(r)
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
 }
@@ -137,8 +185,15 @@ func (h *MetricsHandler) GetMetricJSON(w http.ResponseWriter, r *http.Request) {
 		"id":   metric.ID,
 		"type": metric.MType,
 	}
+	if len(metric.Labels) > 0 {
+		respRaw["labels"] = metric.Labels
+	}
 
-	value, err := h.service.GetMetric(metric.MType, metric.ID)
+	value, err := h.service.GetLabeledMetric(metric.MType, metric.ID, metric.Labels)
+	if errors.Is(err, models.ErrAmbiguousMetric) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
 	if err != nil {
 		h.logger.Warn(
 			"metric not found",
@@ -195,16 +250,339 @@ func (h *MetricsHandler) UpdateMetricJSONBatch(w http.ResponseWriter, r *http.Re
 
 	if err := json.NewDecoder(r.Body).Decode(&metrics); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
+		return
 	}
-	err := h.service.SetMetricBatch(metrics)
+	err := h.service.SetMetricBatch(updateContext(r), metrics)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.trackAgent(r)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// remoteIP returns the client address. X-Real-IP is only used once it passed the trusted
+// subnet check, otherwise any client could claim an address, so the connection address is used.
+func remoteIP(r *http.Request) string {
+	if ip, ok := middleware.TrustedIP(r.Context()); ok {
+		return ip
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// updateContext returns the request context carrying the client address for the audit log.
+func updateContext(r *http.Request) context.Context {
+	return service.WithRemoteIP(r.Context(), remoteIP(r))
+}
+
+// trackAgent records the agent that sent a successful update.
+func (h *MetricsHandler) trackAgent(r *http.Request) {
+	h.service.RecordAgent(models.AgentInfo{
+		ID:         r.Header.Get(models.AgentIDHeader),
+		Version:    r.Header.Get(models.AgentVersionHeader),
+		RemoteAddr: remoteIP(r),
+		LastSeen:   time.Now(),
+	})
+}
+
+func (h *MetricsHandler) ListAgents(w http.ResponseWriter, r *http.Request) {
+	resp, err := json.Marshal(h.service.ListAgents())
+	if err != nil {
+		h.logger.Error("failed to marshal response", "error", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(resp)
+}
+
+func (h *MetricsHandler) ListStale(w http.ResponseWriter, r *http.Request) {
+	if h.stale == nil {
+		http.Error(w, "stale detection is disabled", http.StatusNotImplemented)
+		return
+	}
+
+	resp, err := json.Marshal(h.stale.Report())
+	if err != nil {
+		h.logger.Error("failed to marshal response", "error", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(resp)
+}
+
+func (h *MetricsHandler) ListAlerts(w http.ResponseWriter, r *http.Request) {
+	if h.alerts == nil {
+		http.Error(w, "alerting is disabled", http.StatusNotImplemented)
+		return
+	}
+
+	resp, err := json.Marshal(h.alerts.Alerts())
+	if err != nil {
+		h.logger.Error("failed to marshal response", "error", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(resp)
+}
+
+var metricsPage = template.Must(template.New("metrics").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Metrics</title></head>
+<body>
+<table>
+<tr><th>Name</th><th>Type</th><th>Value</th><th>Labels</th></tr>
+{{range .}}<tr><td>{{.Name}}</td><td>{{.Type}}</td><td>{{.Value}}</td><td>{{.Labels}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+type metricRow struct {
+	Name   string
+	Type   string
+	Value  string
+	Labels string
+}
+
+func (h *MetricsHandler) ListMetricsHTML(w http.ResponseWriter, r *http.Request) {
+	metrics, err := h.service.ListMetrics("", "", nil)
+	if err != nil {
+		h.logger.Error("failed to list metrics", "error", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	rows := make([]metricRow, 0, len(metrics))
+	for _, metric := range metrics {
+		row := metricRow{Name: metric.ID, Labels: formatLabels(metric.Labels), Type: metric.MType}
+		switch {
+		case metric.Value != nil:
+			row.Value = strconv.FormatFloat(*metric.Value, 'f', -1, 64)
+		case metric.Delta != nil:
+			row.Value = strconv.FormatInt(*metric.Delta, 10)
+		}
+		rows = append(rows, row)
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	w.WriteHeader(http.StatusOK)
+	if err := metricsPage.Execute(w, rows); err != nil {
+		h.logger.Error("failed to render metrics page", "error", err)
+	}
+}
+
+func (h *MetricsHandler) ListMetricsJSON(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	metricType := r.URL.Query().Get("type")
+	if metricType != "" && metricType != models.Gauge && metricType != models.Counter {
+		http.Error(w, "Invalid metric type", http.StatusBadRequest)
+		return
+	}
+	labels, err := parseLabels(r.URL.Query()["label"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	metrics, err := h.service.ListMetrics(metricType, r.URL.Query().Get("prefix"), labels)
+	if err != nil {
+		h.logger.Error("failed to list metrics", "error", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	resp, err := json.Marshal(metrics)
+	if err != nil {
+		h.logger.Error("failed to marshal response", "error", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(resp)
+}
+
+func (h *MetricsHandler) GetHistory(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	query := r.URL.Query()
+	from, err := parseTime(query.Get("from"), time.Unix(0, 0))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid from: %v", err), http.StatusBadRequest)
+		return
+	}
+	to, err := parseTime(query.Get("to"), time.Now())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid to: %v", err), http.StatusBadRequest)
+		return
+	}
+	step, err := parseStep(query.Get("step"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid step: %v", err), http.StatusBadRequest)
+		return
+	}
+	labels, err := parseLabels(query["label"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	points, err := h.service.GetHistory(chi.URLParam(r, "metricType"), chi.URLParam(r, "metricName"), labels, from, to, step)
+	switch {
+	case errors.Is(err, models.ErrHistoryDisabled):
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	case errors.Is(err, models.ErrMetricNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, models.ErrAmbiguousMetric):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp, err := json.Marshal(points)
+	if err != nil {
+		h.logger.Error("failed to marshal response", "error", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(resp)
+}
+
+// parseLabels parses repeated "name=value" label filters.
+func parseLabels(values []string) (map[string]string, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	labels := make(map[string]string, len(values))
+	for _, value := range values {
+		name, v, ok := strings.Cut(value, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid label filter %q, expected name=value", value)
+		}
+		labels[name] = v
+	}
+	return labels, nil
+}
+
+// formatLabels renders labels as sorted "name=value" pairs separated by commas.
+func formatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for name, value := range labels {
+		pairs = append(pairs, name+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// parseTime accepts RFC 3339 or unix seconds, an empty value yields def.
+func parseTime(value string, def time.Time) (time.Time, error) {
+	if value == "" {
+		return def, nil
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// parseStep accepts a duration like "1m" or a number of seconds.
+func parseStep(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	return time.ParseDuration(value)
+}
+
+func (h *MetricsHandler) DeleteMetric(w http.ResponseWriter, r *http.Request) {
+	labels, err := parseLabels(r.URL.Query()["label"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = h.service.DeleteMetric(chi.URLParam(r, "metricType"), chi.URLParam(r, "metricName"), labels)
+	switch {
+	case errors.Is(err, models.ErrMetricNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, models.ErrAmbiguousMetric):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *MetricsHandler) DeleteMetricJSONBatch(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var metrics []models.Metrics
+	if err := json.NewDecoder(r.Body).Decode(&metrics); err != nil {
+		http.Error(w, "invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.service.DeleteMetricBatch(metrics); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
 }
 
+func (h *MetricsHandler) ResetCounter(w http.ResponseWriter, r *http.Request) {
+	labels, err := parseLabels(r.URL.Query()["label"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = h.service.ResetCounter(chi.URLParam(r, "metricName"), labels)
+	switch {
+	case errors.Is(err, models.ErrMetricNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, models.ErrAmbiguousMetric):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+}
+
 func (h *MetricsHandler) CheckDB(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
@@ -0,0 +1,414 @@
+package handler_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fireflg/ago-musthave-metrics-tpl/internal/encryption"
+	"github.com/fireflg/ago-musthave-metrics-tpl/internal/handler"
+	"github.com/fireflg/ago-musthave-metrics-tpl/internal/middleware"
+	models "github.com/fireflg/ago-musthave-metrics-tpl/internal/model"
+	"github.com/fireflg/ago-musthave-metrics-tpl/internal/repository/memory"
+	"github.com/fireflg/ago-musthave-metrics-tpl/internal/service"
+	"github.com/fireflg/ago-musthave-metrics-tpl/internal/sign"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// testServer configures the handler served by newTestServer.
+type testServer struct {
+	repo      models.MetricsRepository
+	hashKey   string
+	cryptoKey *rsa.PrivateKey
+	trusted   *net.IPNet
+}
+
+type testServerOption func(*testServer)
+
+// withRepo serves repo instead of an empty memory repository.
+func withRepo(repo models.MetricsRepository) testServerOption {
+	return func(s *testServer) { s.repo = repo }
+}
+
+// withHashKey requires admin requests to be signed with key.
+func withHashKey(key string) testServerOption {
+	return func(s *testServer) { s.hashKey = key }
+}
+
+// withCryptoKey requires update bodies to be encrypted for key.
+func withCryptoKey(key *rsa.PrivateKey) testServerOption {
+	return func(s *testServer) { s.cryptoKey = key }
+}
+
+// withTrustedSubnet restricts writes and admin routes to agents from subnet.
+func withTrustedSubnet(subnet *net.IPNet) testServerOption {
+	return func(s *testServer) { s.trusted = subnet }
+}
+
+func newTestServer(t *testing.T, opts ...testServerOption) *httptest.Server {
+	cfg := testServer{repo: memory.NewMemoryRepository()}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	h := handler.NewMetricsHandler(service.NewMetricsService(cfg.repo), zap.NewNop().Sugar(), cfg.hashKey, nil, nil, cfg.cryptoKey, cfg.trusted)
+	srv := httptest.NewServer(h.ServerRouter())
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func doRequest(t *testing.T, method, url, body string) *http.Response {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestListMetrics(t *testing.T) {
+	srv := newTestServer(t)
+
+	doRequest(t, http.MethodPost, srv.URL+"/update/gauge/HeapAlloc/1.5", "")
+	doRequest(t, http.MethodPost, srv.URL+"/update/gauge/Alloc/2", "")
+	doRequest(t, http.MethodPost, srv.URL+"/update/counter/PollCount/3", "")
+
+	resp := doRequest(t, http.MethodGet, srv.URL+"/", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/html", resp.Header.Get("Content-Type"))
+	page, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Contains(t, string(page), "<td>HeapAlloc</td><td>gauge</td><td>1.5</td>")
+	assert.Contains(t, string(page), "<td>PollCount</td><td>counter</td><td>3</td>")
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/values/?type=gauge&prefix=Heap", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var metrics []models.Metrics
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&metrics))
+	require.Len(t, metrics, 1)
+	assert.Equal(t, "HeapAlloc", metrics[0].ID)
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/values/?type=histogram", "")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+type failingListRepo struct {
+	models.MetricsRepository
+}
+
+func (failingListRepo) List(ctx context.Context) ([]models.Metrics, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestListMetrics_RepositoryError(t *testing.T) {
+	srv := newTestServer(t, withRepo(failingListRepo{memory.NewMemoryRepository()}))
+
+	resp := doRequest(t, http.MethodGet, srv.URL+"/values/", "")
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.NotContains(t, string(body), "connection refused")
+}
+
+func TestDeleteAndResetMetrics(t *testing.T) {
+	srv := newTestServer(t)
+
+	doRequest(t, http.MethodPost, srv.URL+"/update/gauge/Old/1", "")
+	doRequest(t, http.MethodPost, srv.URL+"/update/gauge/Older/1", "")
+	doRequest(t, http.MethodPost, srv.URL+"/update/counter/PollCount/3", "")
+
+	resp := doRequest(t, http.MethodDelete, srv.URL+"/value/gauge/Old", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = doRequest(t, http.MethodDelete, srv.URL+"/value/gauge/Old", "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp = doRequest(t, http.MethodDelete, srv.URL+"/values/", `[{"id":"Older","type":"gauge"},{"id":"Old","type":"gauge"}]`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = doRequest(t, http.MethodGet, srv.URL+"/value/gauge/Older", "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp = doRequest(t, http.MethodPost, srv.URL+"/reset/PollCount", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = doRequest(t, http.MethodGet, srv.URL+"/value/counter/PollCount", "")
+	value, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "0", string(value))
+
+	resp = doRequest(t, http.MethodPost, srv.URL+"/reset/Unknown", "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestGetHistory(t *testing.T) {
+	srv := newTestServer(t, withRepo(memory.NewMemoryRepositoryWithHistory(10)))
+
+	doRequest(t, http.MethodPost, srv.URL+"/update/gauge/Alloc/1", "")
+	doRequest(t, http.MethodPost, srv.URL+"/update/gauge/Alloc/3", "")
+
+	resp := doRequest(t, http.MethodGet, srv.URL+"/history/gauge/Alloc", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var points []models.Point
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&points))
+	require.Len(t, points, 2)
+	assert.Equal(t, float64(1), points[0].Value)
+	assert.Equal(t, float64(3), points[1].Value)
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/history/gauge/Alloc?from=yesterday", "")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp = doRequest(t, http.MethodGet, newTestServer(t).URL+"/history/gauge/Alloc", "")
+	assert.Equal(t, http.StatusNotImplemented, resp.StatusCode)
+}
+
+func TestPrometheusMetrics(t *testing.T) {
+	srv := newTestServer(t)
+
+	doRequest(t, http.MethodPost, srv.URL+"/update/gauge/Heap.Alloc/1.5", "")
+	doRequest(t, http.MethodPost, srv.URL+"/update/counter/PollCount/3", "")
+	doRequest(t, http.MethodPost, srv.URL+"/update/counter/1st-run/1", "")
+	doRequest(t, http.MethodGet, srv.URL+"/value/gauge/Unknown", "")
+
+	resp := doRequest(t, http.MethodGet, srv.URL+"/metrics", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, resp.Header.Get("Content-Type"), "text/plain")
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	text := string(body)
+	assert.Contains(t, text, "# TYPE Heap_Alloc gauge\nHeap_Alloc 1.5\n")
+	assert.Contains(t, text, "# TYPE PollCount counter\nPollCount 3\n")
+	assert.Contains(t, text, "# TYPE _1st_run counter\n_1st_run 1\n")
+	assert.Contains(t, text, `http_requests_total{method="POST",status="200"} 3`)
+	assert.Contains(t, text, `http_requests_total{method="GET",status="404"} 1`)
+	assert.Contains(t, text, "http_request_duration_seconds_count 4\n")
+}
+
+func TestPrometheusMetrics_NameCollisions(t *testing.T) {
+	srv := newTestServer(t)
+
+	resp := doRequest(t, http.MethodPost, srv.URL+"/updates/", `[
+		{"id":"a.b","type":"gauge","value":1},
+		{"id":"a/x","type":"gauge","value":1},
+		{"id":"a_b","type":"gauge","value":2},
+		{"id":"a-b","type":"counter","delta":5},
+		{"id":"http_requests_total","type":"counter","delta":7},
+		{"id":"Quoted","type":"gauge","value":1,"labels":{"v":"tab\tcafé \"q\" back\\slash\nline"}}
+	]`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/metrics", "")
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	text := string(body)
+
+	assert.Contains(t, text, "# TYPE a_b gauge\na_b 2\n# TYPE a_x gauge\na_x 1\n")
+	assert.Equal(t, 1, strings.Count(text, "# TYPE a_b "))
+	assert.Equal(t, 1, strings.Count(text, "\na_b "))
+	assert.Equal(t, 1, strings.Count(text, "# TYPE http_requests_total "))
+	assert.NotContains(t, text, "http_requests_total 7")
+	assert.Contains(t, text, "Quoted{v=\"tab\tcafé \\\"q\\\" back\\\\slash\\nline\"} 1\n")
+}
+
+func TestLabeledMetrics(t *testing.T) {
+	srv := newTestServer(t)
+
+	resp := doRequest(t, http.MethodPost, srv.URL+"/updates/", `[
+		{"id":"Alloc","type":"gauge","value":1,"labels":{"host":"a"}},
+		{"id":"Alloc","type":"gauge","value":2,"labels":{"host":"b"}}
+	]`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/values/?label=host=b", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var metrics []models.Metrics
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&metrics))
+	require.Len(t, metrics, 1)
+	assert.Equal(t, 2.0, *metrics[0].Value)
+
+	resp = doRequest(t, http.MethodPost, srv.URL+"/value/", `{"id":"Alloc","type":"gauge","labels":{"host":"a"}}`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var metric models.Metrics
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&metric))
+	assert.Equal(t, 1.0, *metric.Value)
+	assert.Equal(t, map[string]string{"host": "a"}, metric.Labels)
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/values/?label=host", "")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/metrics", "")
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, 1, strings.Count(string(body), "# TYPE Alloc gauge"))
+	assert.Contains(t, string(body), "Alloc{host=\"a\"} 1\n")
+	assert.Contains(t, string(body), "Alloc{host=\"b\"} 2\n")
+}
+
+func TestLabeledSeriesRoutes(t *testing.T) {
+	srv := newTestServer(t, withRepo(memory.NewMemoryRepositoryWithHistory(10)))
+
+	resp := doRequest(t, http.MethodPost, srv.URL+"/updates/", `[
+		{"id":"Alloc","type":"gauge","value":1.5,"labels":{"host":"a"}},
+		{"id":"PollCount","type":"counter","delta":3,"labels":{"host":"a"}}
+	]`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/value/gauge/Alloc", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "1.5", string(body))
+
+	resp = doRequest(t, http.MethodPost, srv.URL+"/value/", `{"id":"PollCount","type":"counter"}`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var metric models.Metrics
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&metric))
+	assert.Equal(t, int64(3), *metric.Delta)
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/history/gauge/Alloc", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var points []models.Point
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&points))
+	assert.Len(t, points, 1)
+
+	resp = doRequest(t, http.MethodPost, srv.URL+"/reset/PollCount", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = doRequest(t, http.MethodGet, srv.URL+"/value/counter/PollCount?label=host=a", "")
+	body, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "0", string(body))
+
+	doRequest(t, http.MethodPost, srv.URL+"/update/", `{"id":"Alloc","type":"gauge","value":2,"labels":{"host":"b"}}`)
+	resp = doRequest(t, http.MethodGet, srv.URL+"/value/gauge/Alloc", "")
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+	resp = doRequest(t, http.MethodGet, srv.URL+"/value/gauge/Alloc?label=host=c", "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp = doRequest(t, http.MethodDelete, srv.URL+"/value/gauge/Alloc?label=host=b", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = doRequest(t, http.MethodDelete, srv.URL+"/value/gauge/Alloc", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = doRequest(t, http.MethodGet, srv.URL+"/value/gauge/Alloc", "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestSignedAdminRoutes(t *testing.T) {
+	const key = "secret"
+	srv := newTestServer(t, withHashKey(key))
+
+	doRequest(t, http.MethodPost, srv.URL+"/update/gauge/Alloc/1", "")
+	doRequest(t, http.MethodPost, srv.URL+"/update/counter/PollCount/3", "")
+
+	resp := doRequest(t, http.MethodDelete, srv.URL+"/value/gauge/Alloc", "")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp = doRequest(t, http.MethodPost, srv.URL+"/reset/PollCount", "")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	signed := func(method, url, body string) *http.Response {
+		req, err := http.NewRequest(method, url, strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set(sign.HeaderName, sign.Sign([]byte(body), key))
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	resp = signed(http.MethodPost, srv.URL+"/reset/PollCount", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NotEmpty(t, resp.Header.Get(sign.HeaderName))
+	resp = signed(http.MethodDelete, srv.URL+"/value/gauge/Alloc", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = signed(http.MethodDelete, srv.URL+"/values/", `[{"id":"PollCount","type":"counter"}]`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestListAgents(t *testing.T) {
+	srv := newTestServer(t)
+
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/updates/", strings.NewReader(`[{"id":"Alloc","type":"gauge","value":1}]`))
+	require.NoError(t, err)
+	req.Header.Set(models.AgentIDHeader, "agent-1")
+	req.Header.Set(models.AgentVersionHeader, "1.2.3")
+	// Without a trusted subnet the claimed address is not checked and is ignored.
+	req.Header.Set(middleware.RealIPHeader, "10.1.2.3")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	doRequest(t, http.MethodPost, srv.URL+"/updates/", `[{"id":"Alloc","type":"gauge","value":2}]`)
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/agents", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var agents []models.AgentInfo
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&agents))
+	require.Len(t, agents, 1)
+	assert.Equal(t, "agent-1", agents[0].ID)
+	assert.Equal(t, "1.2.3", agents[0].Version)
+	assert.Equal(t, "127.0.0.1", agents[0].RemoteAddr)
+	assert.WithinDuration(t, time.Now(), agents[0].LastSeen, time.Minute)
+}
+
+func TestEncryptedUpdates(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	repo := memory.NewMemoryRepository()
+	srv := newTestServer(t, withRepo(repo), withCryptoKey(key))
+
+	body, err := encryption.Encrypt(&key.PublicKey, []byte(`[{"id":"Alloc","type":"gauge","value":1.5}]`))
+	require.NoError(t, err)
+	resp := doRequest(t, http.MethodPost, srv.URL+"/updates/", string(body))
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	value, err := repo.GetGauge(context.Background(), "Alloc", nil)
+	require.NoError(t, err)
+	assert.Equal(t, 1.5, value)
+
+	resp = doRequest(t, http.MethodPost, srv.URL+"/updates/", `[{"id":"Alloc","type":"gauge","value":2}]`)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestTrustedSubnet(t *testing.T) {
+	_, subnet, err := net.ParseCIDR("10.0.0.0/8")
+	require.NoError(t, err)
+
+	srv := newTestServer(t, withTrustedSubnet(subnet))
+
+	resp := doRequest(t, http.MethodPost, srv.URL+"/update/gauge/Alloc/1", "")
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/updates/", strings.NewReader(`[{"id":"Alloc","type":"gauge","value":2}]`))
+	require.NoError(t, err)
+	req.Header.Set(middleware.RealIPHeader, "10.1.2.3")
+	req.Header.Set(models.AgentIDHeader, "agent-1")
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/value/gauge/Alloc", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = doRequest(t, http.MethodDelete, srv.URL+"/value/gauge/Alloc", "")
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	resp = doRequest(t, http.MethodDelete, srv.URL+"/values/", `[{"id":"Alloc","type":"gauge"}]`)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	resp = doRequest(t, http.MethodPost, srv.URL+"/reset/PollCount", "")
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/agents", "")
+	var agents []models.AgentInfo
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&agents))
+	require.Len(t, agents, 1)
+	assert.Equal(t, "10.1.2.3", agents[0].RemoteAddr)
+}
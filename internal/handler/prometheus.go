@@ -0,0 +1,153 @@
+package handler
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/fireflg/ago-musthave-metrics-tpl/internal/middleware"
+	models "github.com/fireflg/ago-musthave-metrics-tpl/internal/model"
+)
+
+// sanitizeMetricName maps a metric ID to a valid Prometheus name [a-zA-Z_:][a-zA-Z0-9_:]*.
+func sanitizeMetricName(name string) string {
+	var b strings.Builder
+	for i, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_', c == ':':
+			b.WriteRune(c)
+		case c >= '0' && c <= '9':
+			if i == 0 {
+				b.WriteRune('_')
+			}
+			b.WriteRune(c)
+		default:
+			b.WriteRune('_')
+		}
+	}
+	if b.Len() == 0 {
+		return "_"
+	}
+	return b.String()
+}
+
+// formatPrometheusLabels renders labels as {name="value",...} with sorted, sanitized names.
+func formatPrometheusLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(labels))
+	for name, value := range labels {
+		pairs = append(pairs, sanitizeMetricName(name)+`="`+escapeLabelValue(value)+`"`)
+	}
+	sort.Strings(pairs)
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// labelValueEscaper escapes the only sequences the text format allows in label values.
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(value string) string {
+	return labelValueEscaper.Replace(value)
+}
+
+// promFamily is the TYPE line and samples written for one sanitized name.
+type promFamily struct {
+	mType   string
+	samples map[string]string
+}
+
+// writePrometheusMetrics writes one TYPE line per sanitized name followed by a sample per label set.
+// Several metrics can sanitize to the same name and labels, one of them is written: a metric whose ID
+// already is the sanitized name wins, otherwise the smallest ID. The family takes the type of the first
+// metric in that order, metrics of the other type are skipped, as are the names reserved by middleware.
+func writePrometheusMetrics(buf *bytes.Buffer, metrics []models.Metrics) {
+	sorted := make([]models.Metrics, len(metrics))
+	copy(sorted, metrics)
+	names := make(map[string]string, len(sorted))
+	for _, metric := range sorted {
+		names[metric.ID] = sanitizeMetricName(metric.ID)
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if names[a.ID] != names[b.ID] {
+			return names[a.ID] < names[b.ID]
+		}
+		if exactA, exactB := a.ID == names[a.ID], b.ID == names[b.ID]; exactA != exactB {
+			return exactA
+		}
+		if a.ID != b.ID {
+			return a.ID < b.ID
+		}
+		return models.LabelsKey(a.Labels) < models.LabelsKey(b.Labels)
+	})
+
+	families := make(map[string]*promFamily, len(sorted))
+	for _, name := range middleware.PrometheusNames {
+		families[name] = nil
+	}
+	var order []string
+	for _, metric := range sorted {
+		var value string
+		switch {
+		case metric.MType == models.Gauge && metric.Value != nil:
+			value = strconv.FormatFloat(*metric.Value, 'g', -1, 64)
+		case metric.MType == models.Counter && metric.Delta != nil:
+			value = strconv.FormatInt(*metric.Delta, 10)
+		default:
+			continue
+		}
+
+		name := names[metric.ID]
+		family, ok := families[name]
+		if !ok {
+			family = &promFamily{mType: metric.MType, samples: make(map[string]string)}
+			families[name] = family
+			order = append(order, name)
+		}
+		if family == nil || family.mType != metric.MType {
+			continue
+		}
+		labels := formatPrometheusLabels(metric.Labels)
+		if _, ok := family.samples[labels]; !ok {
+			family.samples[labels] = value
+		}
+	}
+
+	for _, name := range order {
+		family := families[name]
+		fmt.Fprintf(buf, "# TYPE %s %s\n", name, family.mType)
+		labelSets := make([]string, 0, len(family.samples))
+		for labels := range family.samples {
+			labelSets = append(labelSets, labels)
+		}
+		sort.Strings(labelSets)
+		for _, labels := range labelSets {
+			fmt.Fprintf(buf, "%s%s %s\n", name, labels, family.samples[labels])
+		}
+	}
+}
+
+func (h *MetricsHandler) PrometheusMetrics(w http.ResponseWriter, r *http.Request) {
+	metrics, err := h.service.ListMetrics("", "", nil)
+	if err != nil {
+		h.logger.Error("failed to list metrics", "error", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	var buf bytes.Buffer
+	writePrometheusMetrics(&buf, metrics)
+	if err := h.stats.WritePrometheus(&buf); err != nil {
+		h.logger.Error("failed to render request stats", "error", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
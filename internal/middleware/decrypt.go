@@ -0,0 +1,41 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"io"
+	"net/http"
+
+	"github.com/fireflg/ago-musthave-metrics-tpl/internal/encryption"
+)
+
+// WithDecrypt replaces a request body encrypted with encryption.Encrypt by its plaintext.
+// Bodies that cannot be decrypted are rejected, a nil key disables decryption.
+func WithDecrypt(key *rsa.PrivateKey) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if key == nil {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, "failed to read body", http.StatusBadRequest)
+				return
+			}
+			r.Body.Close()
+
+			plaintext, err := encryption.Decrypt(key, body)
+			if err != nil {
+				http.Error(w, "failed to decrypt body", http.StatusBadRequest)
+				return
+			}
+
+			r.Body = io.NopCloser(bytes.NewReader(plaintext))
+			r.ContentLength = int64(len(plaintext))
+			r.Header.Del("Content-Length")
+			h.ServeHTTP(w, r)
+		})
+	}
+}
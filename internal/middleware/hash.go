@@ -0,0 +1,64 @@
+package middleware
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+
+	"github.com/fireflg/ago-musthave-metrics-tpl/internal/sign"
+)
+
+type hashResponseWriter struct {
+	http.ResponseWriter
+	statusCode  int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (h *hashResponseWriter) WriteHeader(code int) {
+	if h.wroteHeader {
+		return
+	}
+	h.statusCode = code
+	h.wroteHeader = true
+}
+
+func (h *hashResponseWriter) Write(b []byte) (int, error) {
+	return h.body.Write(b)
+}
+
+// WithHash checks the HashSHA256 signature of the request body and signs the response.
+// An empty key disables the check.
+func WithHash(key string) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if key == "" {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, "failed to read body", http.StatusBadRequest)
+				return
+			}
+			r.Body.Close()
+
+			if !sign.Verify(body, key, r.Header.Get(sign.HeaderName)) {
+				http.Error(w, "invalid signature", http.StatusBadRequest)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+
+			hrw := &hashResponseWriter{
+				ResponseWriter: w,
+				statusCode:     http.StatusOK,
+			}
+			h.ServeHTTP(hrw, r)
+
+			w.Header().Set(sign.HeaderName, sign.Sign(hrw.body.Bytes(), key))
+			w.WriteHeader(hrw.statusCode)
+			w.Write(hrw.body.Bytes())
+		})
+	}
+}
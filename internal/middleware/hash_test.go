@@ -0,0 +1,67 @@
+package middleware_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fireflg/ago-musthave-metrics-tpl/internal/middleware"
+	"github.com/fireflg/ago-musthave-metrics-tpl/internal/sign"
+	"github.com/stretchr/testify/assert"
+)
+
+func echoHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var buf bytes.Buffer
+		buf.ReadFrom(r.Body)
+		w.WriteHeader(http.StatusOK)
+		w.Write(buf.Bytes())
+	})
+}
+
+func TestWithHash_ValidSignature(t *testing.T) {
+	body := []byte(`[{"id":"Alloc","type":"gauge","value":1}]`)
+	req := httptest.NewRequest(http.MethodPost, "/updates/", bytes.NewReader(body))
+	req.Header.Set(sign.HeaderName, sign.Sign(body, "secret"))
+	rec := httptest.NewRecorder()
+
+	middleware.WithHash("secret")(echoHandler()).ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, body, rec.Body.Bytes())
+	assert.True(t, sign.Verify(rec.Body.Bytes(), "secret", rec.Header().Get(sign.HeaderName)))
+}
+
+func TestWithHash_InvalidSignature(t *testing.T) {
+	body := []byte(`[{"id":"PollCount","type":"counter","delta":100500}]`)
+
+	for name, signature := range map[string]string{
+		"missing":   "",
+		"wrong key": sign.Sign(body, "other"),
+		"not hex":   "zz",
+	} {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/updates/", bytes.NewReader(body))
+			if signature != "" {
+				req.Header.Set(sign.HeaderName, signature)
+			}
+			rec := httptest.NewRecorder()
+
+			middleware.WithHash("secret")(echoHandler()).ServeHTTP(rec, req)
+
+			assert.Equal(t, http.StatusBadRequest, rec.Code)
+		})
+	}
+}
+
+func TestWithHash_NoKey(t *testing.T) {
+	body := []byte(`{"id":"Alloc","type":"gauge","value":1}`)
+	req := httptest.NewRequest(http.MethodPost, "/update/", bytes.NewReader(body))
+	rec := httptest.NewRecorder()
+
+	middleware.WithHash("")(echoHandler()).ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Empty(t, rec.Header().Get(sign.HeaderName))
+}
@@ -7,7 +7,8 @@ import (
 	"go.uber.org/zap"
 )
 
-func WithLogging(logger *zap.SugaredLogger) func(http.Handler) http.Handler {
+// WithLogging logs every request and, when stats is not nil, records it there.
+func WithLogging(logger *zap.SugaredLogger, stats *RequestStats) func(http.Handler) http.Handler {
 	return func(h http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			start := time.Now()
@@ -20,6 +21,9 @@ func WithLogging(logger *zap.SugaredLogger) func(http.Handler) http.Handler {
 			h.ServeHTTP(lrw, r)
 
 			duration := time.Since(start)
+			if stats != nil {
+				stats.Observe(r.Method, lrw.statusCode, duration)
+			}
 
 			defer func() {
 				if err := recover(); err != nil {
@@ -0,0 +1,86 @@
+package middleware
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type requestKey struct {
+	method string
+	status int
+}
+
+// RequestStats counts handled requests by method and status and sums their latency.
+type RequestStats struct {
+	mu       sync.Mutex
+	requests map[requestKey]uint64
+	duration time.Duration
+	count    uint64
+}
+
+func NewRequestStats() *RequestStats {
+	return &RequestStats{
+		requests: make(map[requestKey]uint64),
+	}
+}
+
+func (s *RequestStats) Observe(method string, status int, duration time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests[requestKey{method: method, status: status}]++
+	s.duration += duration
+	s.count++
+}
+
+// PrometheusNames are the metric names written by WritePrometheus,
+// other exporters on the same page must not use them.
+var PrometheusNames = []string{
+	"http_requests_total",
+	"http_request_duration_seconds",
+	"http_request_duration_seconds_sum",
+	"http_request_duration_seconds_count",
+}
+
+// WritePrometheus renders the stats in Prometheus text exposition format.
+func (s *RequestStats) WritePrometheus(w io.Writer) error {
+	s.mu.Lock()
+	keys := make([]requestKey, 0, len(s.requests))
+	for key := range s.requests {
+		keys = append(keys, key)
+	}
+	requests := make(map[requestKey]uint64, len(s.requests))
+	for key, n := range s.requests {
+		requests[key] = n
+	}
+	duration, count := s.duration, s.count
+	s.mu.Unlock()
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].method != keys[j].method {
+			return keys[i].method < keys[j].method
+		}
+		return keys[i].status < keys[j].status
+	})
+
+	if _, err := io.WriteString(w, "# HELP http_requests_total Number of HTTP requests handled by the server.\n"+
+		"# TYPE http_requests_total counter\n"); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if _, err := fmt.Fprintf(w, "http_requests_total{method=%q,status=\"%d\"} %d\n", key.method, key.status, requests[key]); err != nil {
+			return err
+		}
+	}
+
+	_, err := fmt.Fprintf(w, "# HELP http_request_duration_seconds Time spent handling HTTP requests.\n"+
+		"# TYPE http_request_duration_seconds summary\n"+
+		"http_request_duration_seconds_sum %s\n"+
+		"http_request_duration_seconds_count %d\n",
+		strconv.FormatFloat(duration.Seconds(), 'g', -1, 64), count)
+	return err
+}
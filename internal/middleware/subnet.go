@@ -0,0 +1,39 @@
+package middleware
+
+import (
+	"context"
+	"net"
+	"net/http"
+)
+
+// RealIPHeader carries the address of the agent that sent the request.
+const RealIPHeader = "X-Real-IP"
+
+type trustedIPKey struct{}
+
+// TrustedIP returns the X-Real-IP of a request accepted by WithTrustedSubnet.
+// It reports false when the address was not checked against a subnet.
+func TrustedIP(ctx context.Context) (string, bool) {
+	ip, ok := ctx.Value(trustedIPKey{}).(string)
+	return ip, ok
+}
+
+// WithTrustedSubnet rejects requests whose X-Real-IP is missing or outside subnet with 403.
+// A nil subnet accepts every request without checking X-Real-IP.
+func WithTrustedSubnet(subnet *net.IPNet) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if subnet == nil {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			ip := net.ParseIP(r.Header.Get(RealIPHeader))
+			if ip == nil || !subnet.Contains(ip) {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+			h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), trustedIPKey{}, ip.String())))
+		})
+	}
+}
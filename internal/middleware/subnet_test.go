@@ -0,0 +1,38 @@
+package middleware_test
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fireflg/ago-musthave-metrics-tpl/internal/middleware"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithTrustedSubnet(t *testing.T) {
+	_, subnet, err := net.ParseCIDR("192.168.1.0/24")
+	require.NoError(t, err)
+
+	for realIP, want := range map[string]int{
+		"192.168.1.10": http.StatusOK,
+		"192.168.2.10": http.StatusForbidden,
+		"not-an-ip":    http.StatusForbidden,
+		"":             http.StatusForbidden,
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/updates/", nil)
+		if realIP != "" {
+			req.Header.Set(middleware.RealIPHeader, realIP)
+		}
+		rec := httptest.NewRecorder()
+
+		middleware.WithTrustedSubnet(subnet)(echoHandler()).ServeHTTP(rec, req)
+		assert.Equal(t, want, rec.Code, realIP)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/updates/", nil)
+	rec := httptest.NewRecorder()
+	middleware.WithTrustedSubnet(nil)(echoHandler()).ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
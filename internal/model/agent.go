@@ -0,0 +1,18 @@
+package models
+
+import "time"
+
+const (
+	// AgentIDHeader carries the stable ID of the agent that sent a request.
+	AgentIDHeader = "X-Agent-ID"
+	// AgentVersionHeader carries the version of the agent that sent a request.
+	AgentVersionHeader = "X-Agent-Version"
+)
+
+// AgentInfo describes the last update received from an agent.
+type AgentInfo struct {
+	ID         string    `json:"id"`
+	Version    string    `json:"version,omitempty"`
+	RemoteAddr string    `json:"remote_addr"`
+	LastSeen   time.Time `json:"last_seen"`
+}
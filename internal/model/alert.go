@@ -0,0 +1,22 @@
+package models
+
+import "time"
+
+const (
+	AlertPending  = "pending"
+	AlertFiring   = "firing"
+	AlertResolved = "resolved"
+)
+
+// Alert is the state of an alerting rule for a single metric.
+type Alert struct {
+	Rule        string            `json:"rule"`
+	Expr        string            `json:"expr"`
+	Metric      string            `json:"metric"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	State       string            `json:"state"`
+	Value       float64           `json:"value"`
+	ActiveSince time.Time         `json:"active_since"`
+	FiredAt     time.Time         `json:"fired_at,omitzero"`
+	ResolvedAt  time.Time         `json:"resolved_at,omitzero"`
+}
@@ -0,0 +1,8 @@
+package models
+
+// AuditEvent describes an accepted metric update.
+type AuditEvent struct {
+	TS        int64    `json:"ts"`
+	Metrics   []string `json:"metrics"`
+	IPAddress string   `json:"ip_address"`
+}
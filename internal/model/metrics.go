@@ -1,6 +1,12 @@
 package models
 
-import "context"
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
 
 const (
 	Counter = "counter"
@@ -17,18 +23,105 @@ const (
 //		ID string `json:"id"`
 //	}
 type Metrics struct {
-	ID    string   `json:"id"`
-	MType string   `json:"type"`
-	Delta *int64   `json:"delta,omitempty"`
-	Value *float64 `json:"value,omitempty"`
-	Hash  string   `json:"hash,omitempty"`
+	ID     string            `json:"id"`
+	MType  string            `json:"type"`
+	Delta  *int64            `json:"delta,omitempty"`
+	Value  *float64          `json:"value,omitempty"`
+	Hash   string            `json:"hash,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+	// UpdatedAt is set by the repository on every write.
+	UpdatedAt time.Time `json:"updated_at,omitzero"`
+}
+
+// LabelsKey returns a canonical encoding of labels, empty when there are none.
+func LabelsKey(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	// encoding/json writes map keys sorted, so equal label sets encode equally.
+	data, _ := json.Marshal(labels)
+	return string(data)
+}
+
+// ParseLabelsKey decodes labels encoded by LabelsKey.
+func ParseLabelsKey(key string) (map[string]string, error) {
+	if key == "" {
+		return nil, nil
+	}
+	var labels map[string]string
+	if err := json.Unmarshal([]byte(key), &labels); err != nil {
+		return nil, fmt.Errorf("invalid labels %q: %w", key, err)
+	}
+	return labels, nil
+}
+
+// Key identifies a stored metric by its ID and label set.
+func (m Metrics) Key() string {
+	return m.ID + LabelsKey(m.Labels)
 }
 
+// HasLabels reports whether every label in labels is set on the metric with the same value.
+func (m Metrics) HasLabels(labels map[string]string) bool {
+	for name, value := range labels {
+		if v, ok := m.Labels[name]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// Validate checks that the metric has an ID and the value required by its type.
+func (m Metrics) Validate() error {
+	if m.ID == "" {
+		return errors.New("metric ID is empty")
+	}
+	switch m.MType {
+	case Counter:
+		if m.Delta == nil {
+			return errors.New("counter metric delta is nil")
+		}
+	case Gauge:
+		if m.Value == nil {
+			return errors.New("gauge metric value is nil")
+		}
+	default:
+		return fmt.Errorf("unknown metric type: %s", m.MType)
+	}
+	return nil
+}
+
+// Point is a metric value recorded at a moment in time.
+// Counters are recorded with their accumulated value.
+type Point struct {
+	Timestamp time.Time `json:"timestamp"`
+	Value     float64   `json:"value"`
+}
+
+var (
+	ErrMetricNotFound  = errors.New("metric not found")
+	ErrHistoryDisabled = errors.New("metric history is disabled")
+	// ErrAmbiguousMetric is returned when no labels are given and several labeled series share the name.
+	ErrAmbiguousMetric = errors.New("metric has several labeled series, labels are required")
+)
+
+// MetricsRepository stores metrics keyed by ID and label set.
+// Methods addressing a single series take its labels; with no labels they use the
+// unlabeled series or, when there is none, the only series of that name and type.
 type MetricsRepository interface {
-	GetCounter(ctx context.Context, name string) (int64, error)
+	GetCounter(ctx context.Context, name string, labels map[string]string) (int64, error)
 	SetCounter(ctx context.Context, name string, value int64) error
-	GetGauge(ctx context.Context, name string) (float64, error)
+	GetGauge(ctx context.Context, name string, labels map[string]string) (float64, error)
 	SetGauge(ctx context.Context, name string, value float64) error
 	SetMetric(ctx context.Context, metric Metrics) error
+	SetMetrics(ctx context.Context, metrics []Metrics) error
+	List(ctx context.Context) ([]Metrics, error)
+	Delete(ctx context.Context, metricType string, name string, labels map[string]string) error
+	// DeleteMetrics removes the series of every metric in the batch, or none of them on error.
+	// Series that do not exist are skipped.
+	DeleteMetrics(ctx context.Context, metrics []Metrics) error
+	ResetCounter(ctx context.Context, name string, labels map[string]string) error
+	History(ctx context.Context, metricType string, name string, labels map[string]string, from, to time.Time) ([]Point, error)
 	Ping(ctx context.Context) error
+	// Close flushes pending state and releases the storage, the repository must not be used afterwards.
+	Close(ctx context.Context) error
 }
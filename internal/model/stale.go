@@ -0,0 +1,10 @@
+package models
+
+import "time"
+
+// StaleReport lists metrics and agents that were not updated within the stale TTL.
+type StaleReport struct {
+	CheckedAt time.Time   `json:"checked_at"`
+	Metrics   []Metrics   `json:"metrics"`
+	Agents    []AgentInfo `json:"agents"`
+}
@@ -0,0 +1,76 @@
+package proto
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative metrics.proto
+
+import (
+	"fmt"
+
+	models "github.com/fireflg/ago-musthave-metrics-tpl/internal/model"
+)
+
+const (
+	// AgentIDKey and AgentVersionKey are the gRPC metadata keys identifying the agent.
+	AgentIDKey      = "x-agent-id"
+	AgentVersionKey = "x-agent-version"
+	// RealIPKey carries the outbound address of the agent.
+	RealIPKey = "x-real-ip"
+	// HashKey is the gRPC metadata key with the HMAC-SHA256 of the deterministically marshaled request.
+	HashKey = "hashsha256"
+)
+
+// TypeFromModel converts a metric type name, "" maps to TYPE_UNSPECIFIED.
+func TypeFromModel(metricType string) (Metric_Type, error) {
+	switch metricType {
+	case "":
+		return Metric_TYPE_UNSPECIFIED, nil
+	case models.Gauge:
+		return Metric_GAUGE, nil
+	case models.Counter:
+		return Metric_COUNTER, nil
+	default:
+		return Metric_TYPE_UNSPECIFIED, fmt.Errorf("unknown metric type: %s", metricType)
+	}
+}
+
+// ModelType converts t to a metric type name, TYPE_UNSPECIFIED maps to "".
+func (t Metric_Type) ModelType() string {
+	switch t {
+	case Metric_GAUGE:
+		return models.Gauge
+	case Metric_COUNTER:
+		return models.Counter
+	default:
+		return ""
+	}
+}
+
+// FromModel converts a stored or reported metric to its protobuf form.
+func FromModel(metric models.Metrics) (*Metric, error) {
+	metricType, err := TypeFromModel(metric.MType)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Metric{Id: metric.ID, Type: metricType, Labels: metric.Labels}
+	if metric.Delta != nil {
+		result.Delta = *metric.Delta
+	}
+	if metric.Value != nil {
+		result.Value = *metric.Value
+	}
+	return result, nil
+}
+
+// ToModel converts m to a metric with the field required by its type set.
+func (m *Metric) ToModel() models.Metrics {
+	result := models.Metrics{ID: m.GetId(), MType: m.GetType().ModelType(), Labels: m.GetLabels()}
+	switch m.GetType() {
+	case Metric_GAUGE:
+		value := m.GetValue()
+		result.Value = &value
+	case Metric_COUNTER:
+		delta := m.GetDelta()
+		result.Delta = &delta
+	}
+	return result
+}
@@ -6,141 +6,433 @@ import (
 	"errors"
 	"fmt"
 	models "github.com/fireflg/ago-musthave-metrics-tpl/internal/model"
-	_ "github.com/golang-migrate/migrate/v4/source/file"
 	_ "github.com/jackc/pgx/v5/stdlib"
-	"log"
+	"sort"
+	"strings"
 	"time"
 )
 
 type PostgresRepository struct {
 	DB *sql.DB
+	// HistorySize makes every upsert also append the resulting value to metric_history,
+	// keeping the last HistorySize rows per series like the memory repository. Zero disables history.
+	HistorySize int
 }
 
-func NewPostgresRepository(dsn string) models.MetricsRepository {
-	db, _ := sql.Open("pgx", dsn)
+// NewPostgresRepository applies pending migrations over a separate connection
+// and opens the connection pool used by the repository.
+func NewPostgresRepository(dsn string, historySize int) (models.MetricsRepository, error) {
+	if err := RunMigrations(dsn, 0); err != nil {
+		return nil, fmt.Errorf("NewPostgresRepository: %w", err)
+	}
 
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("NewPostgresRepository: open database: %w", err)
+	}
 	db.SetMaxOpenConns(25)
 	db.SetMaxIdleConns(25)
 	db.SetConnMaxLifetime(5 * time.Minute)
 
-	if err := createMetricsTableIfNotExists(db); err != nil {
-		log.Printf("Warning: failed to create metrics table: %v", err)
+	return &PostgresRepository{DB: db, HistorySize: historySize}, nil
+}
+
+// Close closes the connection pool, waiting for running queries until ctx is done.
+func (r *PostgresRepository) Close(ctx context.Context) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- r.DB.Close()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("close database: %w", ctx.Err())
 	}
+}
 
-	return &PostgresRepository{DB: db}
+func (r *PostgresRepository) GetGauge(ctx context.Context, name string, labels map[string]string) (float64, error) {
+	row, err := r.series(ctx, r.DB, models.Gauge, name, labels)
+	if err != nil {
+		return 0, err
+	}
+	if !row.value.Valid {
+		return 0, errors.New("gauge value is nil")
+	}
+	return row.value.Float64, nil
 }
 
-func (r *PostgresRepository) Close() error {
-	return r.DB.Close()
+// seriesRow is a row of the metrics table selected by series.
+type seriesRow struct {
+	labels string
+	delta  sql.NullInt64
+	value  sql.NullFloat64
 }
 
-func createMetricsTableIfNotExists(db *sql.DB) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	query := `
-    CREATE TABLE IF NOT EXISTS metrics (
-        id    VARCHAR(255) PRIMARY KEY,
-        type VARCHAR(255) NOT NULL,
-        delta INTEGER,
-        value DOUBLE PRECISION,
-        hash  VARCHAR(64)
-    )`
-	_, err := db.ExecContext(ctx, query)
-	return err
+// querier runs queries on the database or within a transaction.
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
 }
 
-func (r *PostgresRepository) GetGauge(ctx context.Context, name string) (float64, error) {
-	const (
-		maxRetries = 3
-		retryDelay = 10 * time.Millisecond
+// series finds the series of the given type selected by name and labels, see models.MetricsRepository.
+// The unlabeled series sorts first, so two rows without it mean the name is ambiguous.
+func (r *PostgresRepository) series(ctx context.Context, q querier, metricType string, name string, labels map[string]string) (seriesRow, error) {
+	rows, err := q.QueryContext(ctx,
+		`SELECT labels, delta, value FROM metrics
+		 WHERE id = $1 AND type = $2 AND ($3 = '' OR labels = $3)
+		 ORDER BY labels LIMIT 2`,
+		name, metricType, models.LabelsKey(labels),
 	)
+	if err != nil {
+		return seriesRow{}, err
+	}
+	defer rows.Close()
 
-	var lastErr error
+	var found []seriesRow
+	for rows.Next() {
+		var row seriesRow
+		if err := rows.Scan(&row.labels, &row.delta, &row.value); err != nil {
+			return seriesRow{}, err
+		}
+		found = append(found, row)
+	}
+	if err := rows.Err(); err != nil {
+		return seriesRow{}, err
+	}
 
-	for i := 0; i < maxRetries; i++ {
-		var value float64
+	switch {
+	case len(found) == 0:
+		return seriesRow{}, models.ErrMetricNotFound
+	case len(found) == 1 || found[0].labels == "":
+		return found[0], nil
+	default:
+		return seriesRow{}, models.ErrAmbiguousMetric
+	}
+}
 
-		row := r.DB.QueryRowContext(ctx,
-			`SELECT value FROM metrics WHERE id = $1 AND type = 'gauge'`,
-			name,
-		)
+func (r *PostgresRepository) SetGauge(ctx context.Context, name string, value float64) error {
+	_, err := r.DB.ExecContext(ctx,
+		r.upsert(`INSERT INTO metrics (id, type, value) VALUES ($1, 'gauge', $2)
+         ON CONFLICT (id, labels) DO UPDATE SET type = EXCLUDED.type, value = $2, delta = NULL, updated_at = now()`),
+		name, value,
+	)
+	return err
+}
 
-		err := row.Scan(&value)
-		if err == nil {
-			return value, nil
+// metricKey identifies a row of the metrics table.
+type metricKey struct {
+	id     string
+	labels string
+}
+
+// SetMetrics applies a batch in a single transaction with one multi-row upsert per kind of write.
+// Rows are upserted in key order so concurrent batches lock them in the same order.
+// Like the memory repository the batch is applied in order, so when a key changes type
+// the last type wins: a gauge replaces a counter, and a counter replacing a gauge
+// within the batch starts from the deltas that follow it.
+func (r *PostgresRepository) SetMetrics(ctx context.Context, metrics []models.Metrics) error {
+	counters := make(map[metricKey]int64)
+	resets := make(map[metricKey]int64)
+	gauges := make(map[metricKey]float64)
+	for _, metric := range metrics {
+		if err := metric.Validate(); err != nil {
+			return err
+		}
+		key := metricKey{id: metric.ID, labels: models.LabelsKey(metric.Labels)}
+		switch metric.MType {
+		case models.Counter:
+			if _, ok := gauges[key]; ok {
+				delete(gauges, key)
+				resets[key] = 0
+			}
+			if _, ok := resets[key]; ok {
+				resets[key] += *metric.Delta
+			} else {
+				counters[key] += *metric.Delta
+			}
+		case models.Gauge:
+			delete(counters, key)
+			delete(resets, key)
+			gauges[key] = *metric.Value
 		}
+	}
+	if len(counters) == 0 && len(resets) == 0 && len(gauges) == 0 {
+		return nil
+	}
 
-		if !errors.Is(err, sql.ErrNoRows) {
-			return 0, err
+	tx, err := r.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if len(counters) > 0 {
+		values, args := upsertValues(counters, "counter")
+		_, err := tx.ExecContext(ctx, r.upsert(`
+		INSERT INTO metrics AS m (id, type, delta, labels)
+		VALUES `+values+`
+		ON CONFLICT (id, labels)
+		DO UPDATE SET type = EXCLUDED.type,
+			delta = CASE WHEN m.type = 'counter' THEN COALESCE(m.delta, 0) ELSE 0 END + EXCLUDED.delta,
+			value = NULL, updated_at = now()
+		`), args...)
+		if err != nil {
+			return err
 		}
+	}
 
-		lastErr = err
+	if len(resets) > 0 {
+		values, args := upsertValues(resets, "counter")
+		_, err := tx.ExecContext(ctx, r.upsert(`
+		INSERT INTO metrics (id, type, delta, labels)
+		VALUES `+values+`
+		ON CONFLICT (id, labels)
+		DO UPDATE SET type = EXCLUDED.type, delta = EXCLUDED.delta, value = NULL, updated_at = now()
+		`), args...)
+		if err != nil {
+			return err
+		}
+	}
 
-		select {
-		case <-ctx.Done():
-			return 0, ctx.Err()
-		case <-time.After(retryDelay):
+	if len(gauges) > 0 {
+		values, args := upsertValues(gauges, "gauge")
+		_, err := tx.ExecContext(ctx, r.upsert(`
+		INSERT INTO metrics (id, type, value, labels)
+		VALUES `+values+`
+		ON CONFLICT (id, labels)
+		DO UPDATE SET type = EXCLUDED.type, value = EXCLUDED.value, delta = NULL, updated_at = now()
+		`), args...)
+		if err != nil {
+			return err
 		}
 	}
 
-	return 0, lastErr
+	return tx.Commit()
 }
 
-func (r *PostgresRepository) SetGauge(ctx context.Context, name string, value float64) error {
-	_, err := r.DB.ExecContext(ctx,
-		`INSERT INTO metrics (id, type, value) VALUES ($1, 'gauge', $2)
-         ON CONFLICT (id) DO UPDATE SET value = $2`,
-		name, value,
-	)
-	return err
+// upsertValues builds a "($1, 'type', $2, $3), ..." VALUES list sorted by key.
+func upsertValues[T int64 | float64](rows map[metricKey]T, metricType string) (string, []any) {
+	keys := make([]metricKey, 0, len(rows))
+	for key := range rows {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].id != keys[j].id {
+			return keys[i].id < keys[j].id
+		}
+		return keys[i].labels < keys[j].labels
+	})
+
+	values := make([]string, 0, len(keys))
+	args := make([]any, 0, 3*len(keys))
+	for i, key := range keys {
+		values = append(values, fmt.Sprintf("($%d, '%s', $%d, $%d)", 3*i+1, metricType, 3*i+2, 3*i+3))
+		args = append(args, key.id, rows[key], key.labels)
+	}
+	return strings.Join(values, ", "), args
 }
 
-func (r *PostgresRepository) Ping(ctx context.Context) error {
-	return r.DB.PingContext(ctx)
+// upsert turns an INSERT ... ON CONFLICT or UPDATE statement into one that also records
+// the resulting values in metric_history when history is enabled. It deletes the rows of
+// the written series beyond the newest HistorySize-1, which together with the new row
+// keeps HistorySize per series.
+func (r *PostgresRepository) upsert(query string) string {
+	if r.HistorySize <= 0 {
+		return query
+	}
+	return `WITH upserted AS (` + query + ` RETURNING id, type, labels, delta, value)` + fmt.Sprintf(`, pruned AS (
+		DELETE FROM metric_history h
+		USING (
+			SELECT ctid, row_number() OVER (PARTITION BY id, type, labels ORDER BY created_at DESC) AS n
+			FROM metric_history
+			WHERE (id, type, labels) IN (SELECT id, type, labels FROM upserted)
+		) ranked
+		WHERE h.ctid = ranked.ctid AND ranked.n >= %d)`, r.HistorySize) + `
+		INSERT INTO metric_history (id, type, labels, value)
+		SELECT id, type, labels, COALESCE(value, delta::DOUBLE PRECISION) FROM upserted`
 }
 
-func (r *PostgresRepository) GetCounter(ctx context.Context, name string) (int64, error) {
-	const (
-		maxRetries = 3
-		retryDelay = 50 * time.Millisecond
-	)
+func (r *PostgresRepository) History(ctx context.Context, metricType string, name string, labels map[string]string, from, to time.Time) ([]models.Point, error) {
+	if r.HistorySize <= 0 {
+		return nil, models.ErrHistoryDisabled
+	}
+	series, err := r.series(ctx, r.DB, metricType, name, labels)
+	if err != nil {
+		return nil, err
+	}
 
-	var lastErr error
+	rows, err := r.DB.QueryContext(ctx,
+		`SELECT created_at, value FROM metric_history
+		 WHERE id = $1 AND type = $2 AND labels = $3 AND created_at BETWEEN $4 AND $5
+		 ORDER BY created_at`,
+		name, metricType, series.labels, from, to,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-	for i := 0; i < maxRetries; i++ {
-		var value int64
+	result := make([]models.Point, 0)
+	for rows.Next() {
+		var point models.Point
+		if err := rows.Scan(&point.Timestamp, &point.Value); err != nil {
+			return nil, err
+		}
+		result = append(result, point)
+	}
+	return result, rows.Err()
+}
 
-		row := r.DB.QueryRowContext(ctx,
-			`SELECT m.delta FROM metrics m WHERE m.id = $1 AND m.type = 'counter'`,
-			name,
+func (r *PostgresRepository) List(ctx context.Context) ([]models.Metrics, error) {
+	rows, err := r.DB.QueryContext(ctx,
+		`SELECT id, type, labels, delta, value, updated_at FROM metrics ORDER BY id, labels`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []models.Metrics
+	for rows.Next() {
+		var (
+			metric models.Metrics
+			labels string
+			delta  sql.NullInt64
+			value  sql.NullFloat64
 		)
-
-		err := row.Scan(&value)
-		if err == nil {
-			return value, nil
+		if err := rows.Scan(&metric.ID, &metric.MType, &labels, &delta, &value, &metric.UpdatedAt); err != nil {
+			return nil, err
+		}
+		if metric.Labels, err = models.ParseLabelsKey(labels); err != nil {
+			return nil, err
 		}
+		if delta.Valid {
+			metric.Delta = &delta.Int64
+		}
+		if value.Valid {
+			metric.Value = &value.Float64
+		}
+		result = append(result, metric)
+	}
+	return result, rows.Err()
+}
+
+// Delete removes the series and its history in one transaction.
+func (r *PostgresRepository) Delete(ctx context.Context, metricType string, name string, labels map[string]string) error {
+	tx, err := r.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := r.deleteSeries(ctx, tx, metricType, name, labels); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
 
-		if !errors.Is(err, sql.ErrNoRows) {
-			return 0, err
+// DeleteMetrics removes the whole batch in one transaction, so a failed delete keeps every series.
+func (r *PostgresRepository) DeleteMetrics(ctx context.Context, metrics []models.Metrics) error {
+	for _, metric := range metrics {
+		if metric.MType != models.Gauge && metric.MType != models.Counter {
+			return fmt.Errorf("unknown metric type: %s", metric.MType)
 		}
+	}
+	if len(metrics) == 0 {
+		return nil
+	}
 
-		lastErr = err
+	tx, err := r.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
-		select {
-		case <-ctx.Done():
-			return 0, ctx.Err()
-		case <-time.After(retryDelay):
+	for _, metric := range metrics {
+		err := r.deleteSeries(ctx, tx, metric.MType, metric.ID, metric.Labels)
+		if err != nil && !errors.Is(err, models.ErrMetricNotFound) {
+			return err
 		}
 	}
+	return tx.Commit()
+}
+
+// deleteSeries removes the series selected by name and labels and its history within tx.
+func (r *PostgresRepository) deleteSeries(ctx context.Context, tx *sql.Tx, metricType string, name string, labels map[string]string) error {
+	series, err := r.series(ctx, tx, metricType, name, labels)
+	if err != nil {
+		return err
+	}
+
+	res, err := tx.ExecContext(ctx,
+		`DELETE FROM metrics WHERE id = $1 AND type = $2 AND labels = $3`,
+		name, metricType, series.labels,
+	)
+	if err != nil {
+		return err
+	}
+	if err := checkAffected(res); err != nil {
+		return err
+	}
+	if r.HistorySize > 0 {
+		_, err = tx.ExecContext(ctx,
+			`DELETE FROM metric_history WHERE id = $1 AND type = $2 AND labels = $3`,
+			name, metricType, series.labels,
+		)
+	}
+	return err
+}
+
+func (r *PostgresRepository) ResetCounter(ctx context.Context, name string, labels map[string]string) error {
+	series, err := r.series(ctx, r.DB, models.Counter, name, labels)
+	if err != nil {
+		return err
+	}
+
+	res, err := r.DB.ExecContext(ctx,
+		r.upsert(`UPDATE metrics SET delta = 0, updated_at = now() WHERE id = $1 AND type = 'counter' AND labels = $2`),
+		name, series.labels,
+	)
+	if err != nil {
+		return err
+	}
+	return checkAffected(res)
+}
+
+func checkAffected(res sql.Result) error {
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return models.ErrMetricNotFound
+	}
+	return nil
+}
 
-	return 0, lastErr
+func (r *PostgresRepository) Ping(ctx context.Context) error {
+	return r.DB.PingContext(ctx)
+}
+
+func (r *PostgresRepository) GetCounter(ctx context.Context, name string, labels map[string]string) (int64, error) {
+	row, err := r.series(ctx, r.DB, models.Counter, name, labels)
+	if err != nil {
+		return 0, err
+	}
+	if !row.delta.Valid {
+		return 0, errors.New("counter delta is nil")
+	}
+	return row.delta.Int64, nil
 }
 
 func (r *PostgresRepository) SetCounter(ctx context.Context, name string, value int64) error {
 	_, err := r.DB.ExecContext(ctx,
-		`INSERT INTO metrics AS m (id, type, delta) VALUES ($1, 'counter', $2)
-         ON CONFLICT (id) 
-         DO UPDATE SET delta = m.delta + EXCLUDED.delta`,
+		r.upsert(`INSERT INTO metrics AS m (id, type, delta) VALUES ($1, 'counter', $2)
+         ON CONFLICT (id, labels)
+         DO UPDATE SET type = EXCLUDED.type,
+             delta = CASE WHEN m.type = 'counter' THEN COALESCE(m.delta, 0) ELSE 0 END + EXCLUDED.delta,
+             value = NULL, updated_at = now()`),
 		name, value,
 	)
 
@@ -157,12 +449,14 @@ func (r *PostgresRepository) SetMetric(ctx context.Context, metric models.Metric
 			return errors.New("counter metric delta is nil")
 		}
 
-		_, err := r.DB.ExecContext(ctx, `
-		INSERT INTO metrics AS m (id, type, delta)
-		VALUES ($1, 'counter', $2)
-		ON CONFLICT (id)
-		DO UPDATE SET delta = COALESCE(m.delta, 0) + EXCLUDED.delta
-		`, metric.ID, *metric.Delta)
+		_, err := r.DB.ExecContext(ctx, r.upsert(`
+		INSERT INTO metrics AS m (id, type, delta, labels)
+		VALUES ($1, 'counter', $2, $3)
+		ON CONFLICT (id, labels)
+		DO UPDATE SET type = EXCLUDED.type,
+			delta = CASE WHEN m.type = 'counter' THEN COALESCE(m.delta, 0) ELSE 0 END + EXCLUDED.delta,
+			value = NULL, updated_at = now()
+		`), metric.ID, *metric.Delta, models.LabelsKey(metric.Labels))
 		return err
 
 	case "gauge":
@@ -170,12 +464,12 @@ func (r *PostgresRepository) SetMetric(ctx context.Context, metric models.Metric
 			return errors.New("gauge metric value is nil")
 		}
 
-		_, err := r.DB.ExecContext(ctx, `
-			INSERT INTO metrics (id, type, value)
-			VALUES ($1, 'gauge', $2)
-			ON CONFLICT (id)
-			DO UPDATE SET value = EXCLUDED.value
-		`, metric.ID, *metric.Value)
+		_, err := r.DB.ExecContext(ctx, r.upsert(`
+			INSERT INTO metrics (id, type, value, labels)
+			VALUES ($1, 'gauge', $2, $3)
+			ON CONFLICT (id, labels)
+			DO UPDATE SET type = EXCLUDED.type, value = EXCLUDED.value, delta = NULL, updated_at = now()
+		`), metric.ID, *metric.Value, models.LabelsKey(metric.Labels))
 		return err
 
 	default:
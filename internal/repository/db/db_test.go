@@ -2,14 +2,27 @@ package db_test
 
 import (
 	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	models "github.com/fireflg/ago-musthave-metrics-tpl/internal/model"
 	"github.com/fireflg/ago-musthave-metrics-tpl/internal/repository/db"
 	"regexp"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/stretchr/testify/assert"
 )
 
+const selectSeries = `SELECT labels, delta, value FROM metrics`
+
+func seriesRows() *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"labels", "delta", "value"})
+}
+
 func TestSetAndGetGauge(t *testing.T) {
 	mockDB, mock, err := sqlmock.New()
 	assert.NoError(t, err)
@@ -19,20 +32,18 @@ func TestSetAndGetGauge(t *testing.T) {
 
 	mock.ExpectExec(regexp.QuoteMeta(
 		`INSERT INTO metrics (id, type, value) VALUES ($1, 'gauge', $2)
-         ON CONFLICT (id) DO UPDATE SET value = $2`)).
+         ON CONFLICT (id, labels) DO UPDATE SET type = EXCLUDED.type, value = $2, delta = NULL, updated_at = now()`)).
 		WithArgs("gauge1", 1.23).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 
 	err = repo.SetGauge(context.Background(), "gauge1", 1.23)
 	assert.NoError(t, err)
 
-	rows := sqlmock.NewRows([]string{"value"}).AddRow(1.23)
-	mock.ExpectQuery(regexp.QuoteMeta(
-		`SELECT value FROM metrics WHERE id = $1 AND type = 'gauge'`)).
-		WithArgs("gauge1").
-		WillReturnRows(rows)
+	mock.ExpectQuery(regexp.QuoteMeta(selectSeries)).
+		WithArgs("gauge1", "gauge", "").
+		WillReturnRows(seriesRows().AddRow("", nil, 1.23))
 
-	val, err := repo.GetGauge(context.Background(), "gauge1")
+	val, err := repo.GetGauge(context.Background(), "gauge1", nil)
 	assert.NoError(t, err)
 	assert.Equal(t, 1.23, val)
 
@@ -48,21 +59,21 @@ func TestSetAndGetCounter(t *testing.T) {
 
 	mock.ExpectExec(regexp.QuoteMeta(
 		`INSERT INTO metrics AS m (id, type, delta) VALUES ($1, 'counter', $2)
-         ON CONFLICT (id) 
-         DO UPDATE SET delta = m.delta + EXCLUDED.delta`)).
+         ON CONFLICT (id, labels)
+         DO UPDATE SET type = EXCLUDED.type,
+             delta = CASE WHEN m.type = 'counter' THEN COALESCE(m.delta, 0) ELSE 0 END + EXCLUDED.delta,
+             value = NULL, updated_at = now()`)).
 		WithArgs("counter1", int64(10)).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 
 	err = repo.SetCounter(context.Background(), "counter1", 10)
 	assert.NoError(t, err)
 
-	rows := sqlmock.NewRows([]string{"delta"}).AddRow(10)
-	mock.ExpectQuery(regexp.QuoteMeta(
-		`SELECT m.delta FROM metrics m WHERE m.id = $1 AND m.type = 'counter'`)).
-		WithArgs("counter1").
-		WillReturnRows(rows)
+	mock.ExpectQuery(regexp.QuoteMeta(selectSeries)).
+		WithArgs("counter1", "counter", "").
+		WillReturnRows(seriesRows().AddRow("", 10, nil))
 
-	val, err := repo.GetCounter(context.Background(), "counter1")
+	val, err := repo.GetCounter(context.Background(), "counter1", nil)
 	assert.NoError(t, err)
 	assert.Equal(t, int64(10), val)
 
@@ -79,3 +90,380 @@ func TestPing(t *testing.T) {
 	err = repo.Ping(context.Background())
 	assert.NoError(t, err)
 }
+
+func TestList(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer mockDB.Close()
+
+	repo := &db.PostgresRepository{DB: mockDB}
+
+	updatedAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	rows := sqlmock.NewRows([]string{"id", "type", "labels", "delta", "value", "updated_at"}).
+		AddRow("counter1", "counter", "", 10, nil, updatedAt).
+		AddRow("gauge1", "gauge", `{"host":"a"}`, nil, 1.23, updatedAt)
+	mock.ExpectQuery(regexp.QuoteMeta(
+		`SELECT id, type, labels, delta, value, updated_at FROM metrics ORDER BY id, labels`)).
+		WillReturnRows(rows)
+
+	metrics, err := repo.List(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, metrics, 2)
+	assert.Equal(t, int64(10), *metrics[0].Delta)
+	assert.Nil(t, metrics[0].Value)
+	assert.Equal(t, 1.23, *metrics[1].Value)
+	assert.Nil(t, metrics[1].Delta)
+	assert.Nil(t, metrics[0].Labels)
+	assert.Equal(t, map[string]string{"host": "a"}, metrics[1].Labels)
+	assert.Equal(t, updatedAt, metrics[0].UpdatedAt)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestDeleteAndReset(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer mockDB.Close()
+
+	repo := &db.PostgresRepository{DB: mockDB}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(selectSeries)).
+		WithArgs("gauge1", "gauge", "").
+		WillReturnRows(seriesRows().AddRow(`{"host":"a"}`, nil, 1.23))
+	mock.ExpectExec(regexp.QuoteMeta(
+		`DELETE FROM metrics WHERE id = $1 AND type = $2 AND labels = $3`)).
+		WithArgs("gauge1", "gauge", `{"host":"a"}`).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(selectSeries)).
+		WithArgs("missing", "gauge", "").
+		WillReturnRows(seriesRows())
+	mock.ExpectRollback()
+	mock.ExpectQuery(regexp.QuoteMeta(selectSeries)).
+		WithArgs("counter1", "counter", `{"host":"b"}`).
+		WillReturnRows(seriesRows().AddRow(`{"host":"b"}`, 5, nil))
+	mock.ExpectExec(regexp.QuoteMeta(
+		`UPDATE metrics SET delta = 0, updated_at = now() WHERE id = $1 AND type = 'counter' AND labels = $2`)).
+		WithArgs("counter1", `{"host":"b"}`).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(regexp.QuoteMeta(selectSeries)).
+		WithArgs("counter2", "counter", "").
+		WillReturnRows(seriesRows().AddRow(`{"host":"a"}`, 1, nil).AddRow(`{"host":"b"}`, 2, nil))
+
+	assert.NoError(t, repo.Delete(context.Background(), "gauge", "gauge1", nil))
+	assert.ErrorIs(t, repo.Delete(context.Background(), "gauge", "missing", nil), models.ErrMetricNotFound)
+	assert.NoError(t, repo.ResetCounter(context.Background(), "counter1", map[string]string{"host": "b"}))
+	assert.ErrorIs(t, repo.ResetCounter(context.Background(), "counter2", nil), models.ErrAmbiguousMetric)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestDeleteMetrics(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer mockDB.Close()
+
+	repo := &db.PostgresRepository{DB: mockDB, HistorySize: 10}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(selectSeries)).
+		WithArgs("gauge1", "gauge", "").
+		WillReturnRows(seriesRows().AddRow("", nil, 1.23))
+	mock.ExpectExec(regexp.QuoteMeta(
+		`DELETE FROM metrics WHERE id = $1 AND type = $2 AND labels = $3`)).
+		WithArgs("gauge1", "gauge", "").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(
+		`DELETE FROM metric_history WHERE id = $1 AND type = $2 AND labels = $3`)).
+		WithArgs("gauge1", "gauge", "").
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectQuery(regexp.QuoteMeta(selectSeries)).
+		WithArgs("missing", "counter", "").
+		WillReturnRows(seriesRows())
+	mock.ExpectCommit()
+
+	err = repo.DeleteMetrics(context.Background(), []models.Metrics{
+		{ID: "gauge1", MType: "gauge"},
+		{ID: "missing", MType: "counter"},
+	})
+	assert.NoError(t, err)
+
+	// An ambiguous series rolls back the deletes before it.
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(selectSeries)).
+		WithArgs("gauge2", "gauge", "").
+		WillReturnRows(seriesRows().AddRow("", nil, 1.0))
+	mock.ExpectExec(regexp.QuoteMeta(
+		`DELETE FROM metrics WHERE id = $1 AND type = $2 AND labels = $3`)).
+		WithArgs("gauge2", "gauge", "").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(
+		`DELETE FROM metric_history WHERE id = $1 AND type = $2 AND labels = $3`)).
+		WithArgs("gauge2", "gauge", "").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta(selectSeries)).
+		WithArgs("counter2", "counter", "").
+		WillReturnRows(seriesRows().AddRow(`{"host":"a"}`, 1, nil).AddRow(`{"host":"b"}`, 2, nil))
+	mock.ExpectRollback()
+
+	err = repo.DeleteMetrics(context.Background(), []models.Metrics{
+		{ID: "gauge2", MType: "gauge"},
+		{ID: "counter2", MType: "counter"},
+	})
+	assert.ErrorIs(t, err, models.ErrAmbiguousMetric)
+
+	assert.Error(t, repo.DeleteMetrics(context.Background(), []models.Metrics{{ID: "x", MType: "unknown"}}))
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSetMetrics(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer mockDB.Close()
+
+	repo := &db.PostgresRepository{DB: mockDB}
+
+	delta1, delta2 := int64(2), int64(3)
+	value1, value2 := 1.5, 2.5
+	metrics := []models.Metrics{
+		{ID: "PollCount", MType: "counter", Delta: &delta1},
+		{ID: "HeapAlloc", MType: "gauge", Value: &value1},
+		{ID: "PollCount", MType: "counter", Delta: &delta2},
+		{ID: "Alloc", MType: "gauge", Value: &value2},
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`VALUES ($1, 'counter', $2, $3)`)).
+		WithArgs("PollCount", int64(5), "").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`VALUES ($1, 'gauge', $2, $3), ($4, 'gauge', $5, $6)`)).
+		WithArgs("Alloc", 2.5, "", "HeapAlloc", 1.5, "").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+
+	assert.NoError(t, repo.SetMetrics(context.Background(), metrics))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSetMetrics_Labels(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer mockDB.Close()
+
+	repo := &db.PostgresRepository{DB: mockDB}
+
+	value1, value2 := 1.5, 2.5
+	metrics := []models.Metrics{
+		{ID: "Alloc", MType: "gauge", Value: &value1, Labels: map[string]string{"host": "b"}},
+		{ID: "Alloc", MType: "gauge", Value: &value2, Labels: map[string]string{"host": "a"}},
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`VALUES ($1, 'gauge', $2, $3), ($4, 'gauge', $5, $6)`)).
+		WithArgs("Alloc", 2.5, `{"host":"a"}`, "Alloc", 1.5, `{"host":"b"}`).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+
+	assert.NoError(t, repo.SetMetrics(context.Background(), metrics))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSetMetrics_TypeChange(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer mockDB.Close()
+
+	repo := &db.PostgresRepository{DB: mockDB}
+
+	delta1, delta2 := int64(2), int64(3)
+	value1, value2 := 1.5, 2.5
+	metrics := []models.Metrics{
+		{ID: "Alloc", MType: "counter", Delta: &delta1},
+		{ID: "Alloc", MType: "gauge", Value: &value1},
+		{ID: "PollCount", MType: "gauge", Value: &value2},
+		{ID: "PollCount", MType: "counter", Delta: &delta1},
+		{ID: "PollCount", MType: "counter", Delta: &delta2},
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`VALUES ($1, 'counter', $2, $3)
+		ON CONFLICT (id, labels)
+		DO UPDATE SET type = EXCLUDED.type, delta = EXCLUDED.delta`)).
+		WithArgs("PollCount", int64(5), "").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`VALUES ($1, 'gauge', $2, $3)`)).
+		WithArgs("Alloc", 1.5, "").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	assert.NoError(t, repo.SetMetrics(context.Background(), metrics))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSetMetrics_RollbackOnError(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer mockDB.Close()
+
+	repo := &db.PostgresRepository{DB: mockDB}
+
+	delta := int64(1)
+	value := 1.5
+	metrics := []models.Metrics{
+		{ID: "PollCount", MType: "counter", Delta: &delta},
+		{ID: "Alloc", MType: "gauge", Value: &value},
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`VALUES ($1, 'counter', $2, $3)`)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`VALUES ($1, 'gauge', $2, $3)`)).
+		WillReturnError(errors.New("connection reset"))
+	mock.ExpectRollback()
+
+	assert.Error(t, repo.SetMetrics(context.Background(), metrics))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSetMetrics_InvalidBatch(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer mockDB.Close()
+
+	repo := &db.PostgresRepository{DB: mockDB}
+
+	delta := int64(1)
+	metrics := []models.Metrics{
+		{ID: "PollCount", MType: "counter", Delta: &delta},
+		{ID: "Alloc", MType: "gauge"},
+	}
+
+	assert.Error(t, repo.SetMetrics(context.Background(), metrics))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestIsRetriable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"connection failure", &pgconn.PgError{Code: "08006"}, true},
+		{"connection does not exist", &pgconn.PgError{Code: "08003"}, true},
+		{"serialization failure", &pgconn.PgError{Code: "40001"}, true},
+		{"deadlock", fmt.Errorf("exec: %w", &pgconn.PgError{Code: "40P01"}), true},
+		{"bad connection", driver.ErrBadConn, true},
+		{"unique violation", &pgconn.PgError{Code: "23505"}, false},
+		{"syntax error", &pgconn.PgError{Code: "42601"}, false},
+		{"no rows", sql.ErrNoRows, false},
+		{"not found", models.ErrMetricNotFound, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, db.IsRetriable(tt.err))
+		})
+	}
+}
+
+func TestIsRetriableWrite(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"serialization failure", &pgconn.PgError{Code: "40001"}, true},
+		{"deadlock", fmt.Errorf("exec: %w", &pgconn.PgError{Code: "40P01"}), true},
+		{"connect error", &pgconn.ConnectError{}, true},
+		{"connection failure", &pgconn.PgError{Code: "08006"}, false},
+		{"bad connection", driver.ErrBadConn, false},
+		{"unique violation", &pgconn.PgError{Code: "23505"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, db.IsRetriableWrite(tt.err))
+		})
+	}
+}
+
+func TestHistory(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer mockDB.Close()
+
+	repo := &db.PostgresRepository{DB: mockDB, HistorySize: 1000}
+
+	mock.ExpectExec(`WITH upserted AS \(\s*INSERT INTO metrics .* RETURNING id, type, labels, delta, value\), pruned AS .*INSERT INTO metric_history`).
+		WithArgs("gauge1", 1.23, "").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	value := 1.23
+	err = repo.SetMetric(context.Background(), models.Metrics{ID: "gauge1", MType: "gauge", Value: &value})
+	assert.NoError(t, err)
+
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(time.Hour)
+	mock.ExpectQuery(regexp.QuoteMeta(selectSeries)).
+		WithArgs("gauge1", "gauge", "").
+		WillReturnRows(seriesRows().AddRow("", nil, 1.23))
+	mock.ExpectQuery(`SELECT created_at, value FROM metric_history`).
+		WithArgs("gauge1", "gauge", "", from, to).
+		WillReturnRows(sqlmock.NewRows([]string{"created_at", "value"}).
+			AddRow(from.Add(time.Minute), 1.23))
+
+	points, err := repo.History(context.Background(), "gauge", "gauge1", nil, from, to)
+	assert.NoError(t, err)
+	assert.Equal(t, []models.Point{{Timestamp: from.Add(time.Minute), Value: 1.23}}, points)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	_, err = (&db.PostgresRepository{DB: mockDB}).History(context.Background(), "gauge", "gauge1", nil, from, to)
+	assert.ErrorIs(t, err, models.ErrHistoryDisabled)
+}
+
+func TestHistoryResetAndRetention(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer mockDB.Close()
+
+	repo := &db.PostgresRepository{DB: mockDB, HistorySize: 10}
+
+	mock.ExpectExec(`WITH upserted AS \(\s*INSERT INTO metrics .* RETURNING id, type, labels, delta, value\), pruned AS \(\s*DELETE FROM metric_history .* ranked.n >= 10\)\s*INSERT INTO metric_history`).
+		WithArgs("gauge1", 1.23, "").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	value := 1.23
+	assert.NoError(t, repo.SetMetric(context.Background(), models.Metrics{ID: "gauge1", MType: "gauge", Value: &value}))
+
+	mock.ExpectQuery(regexp.QuoteMeta(selectSeries)).
+		WithArgs("counter1", "counter", "").
+		WillReturnRows(seriesRows().AddRow("", 5, nil))
+	mock.ExpectExec(`WITH upserted AS \(UPDATE metrics SET delta = 0, .* RETURNING id, type, labels, delta, value\), pruned AS .*INSERT INTO metric_history`).
+		WithArgs("counter1", "").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	assert.NoError(t, repo.ResetCounter(context.Background(), "counter1", nil))
+
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	mock.ExpectQuery(regexp.QuoteMeta(selectSeries)).
+		WithArgs("missing", "gauge", "").
+		WillReturnRows(seriesRows())
+
+	_, err = repo.History(context.Background(), "gauge", "missing", nil, from, from.Add(time.Hour))
+	assert.ErrorIs(t, err, models.ErrMetricNotFound)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestCloseClosesPool(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+
+	repo := &db.PostgresRepository{DB: mockDB}
+	mock.ExpectClose()
+
+	assert.NoError(t, repo.Close(context.Background()))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
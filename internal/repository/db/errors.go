@@ -0,0 +1,45 @@
+package db
+
+import (
+	"database/sql/driver"
+	"errors"
+	"net"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// IsRetriable reports whether err is a transient Postgres failure:
+// a lost or refused connection, a class 08 connection exception,
+// a serialization failure or a deadlock.
+func IsRetriable(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgerrcode.IsConnectionException(pgErr.Code) ||
+			pgErr.Code == pgerrcode.SerializationFailure ||
+			pgErr.Code == pgerrcode.DeadlockDetected
+	}
+
+	var connectErr *pgconn.ConnectError
+	if errors.As(err, &connectErr) {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.Is(err, driver.ErrBadConn) || errors.As(err, &netErr)
+}
+
+// IsRetriableWrite reports whether a failed write is known not to have been applied:
+// the transaction was rolled back by a serialization failure or a deadlock,
+// or the connection was never established. A lost connection may have
+// committed the write already, so retrying it could count a delta twice.
+func IsRetriableWrite(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code == pgerrcode.SerializationFailure ||
+			pgErr.Code == pgerrcode.DeadlockDetected
+	}
+
+	var connectErr *pgconn.ConnectError
+	return errors.As(err, &connectErr)
+}
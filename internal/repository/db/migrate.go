@@ -0,0 +1,68 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/fireflg/ago-musthave-metrics-tpl/migrations"
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/golang-migrate/migrate/v4/database/pgx/v5"
+	"github.com/golang-migrate/migrate/v4/source/iofs"
+)
+
+func newMigrate(db *sql.DB) (*migrate.Migrate, error) {
+	source, err := iofs.New(migrations.FS, ".")
+	if err != nil {
+		return nil, fmt.Errorf("newMigrate: open source: %w", err)
+	}
+	driver, err := pgx.WithInstance(db, &pgx.Config{})
+	if err != nil {
+		return nil, fmt.Errorf("newMigrate: open database: %w", err)
+	}
+	m, err := migrate.NewWithInstance("iofs", source, "pgx5", driver)
+	if err != nil {
+		return nil, fmt.Errorf("newMigrate: %w", err)
+	}
+	return m, nil
+}
+
+// MigrateUp applies all pending migrations.
+func MigrateUp(db *sql.DB) error {
+	m, err := newMigrate(db)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+	if err := m.Up(); err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		return fmt.Errorf("MigrateUp: %w", err)
+	}
+	return nil
+}
+
+// MigrateDown rolls back the given number of applied migrations.
+func MigrateDown(db *sql.DB, steps int) error {
+	m, err := newMigrate(db)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+	if err := m.Steps(-steps); err != nil {
+		return fmt.Errorf("MigrateDown: %w", err)
+	}
+	return nil
+}
+
+// RunMigrations connects to dsn and either rolls back downSteps migrations or, when downSteps is 0, applies pending ones.
+func RunMigrations(dsn string, downSteps int) error {
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		return fmt.Errorf("RunMigrations: open database: %w", err)
+	}
+	defer db.Close()
+
+	if downSteps > 0 {
+		return MigrateDown(db, downSteps)
+	}
+	return MigrateUp(db)
+}
@@ -0,0 +1,13 @@
+package file
+
+import (
+	"errors"
+	"syscall"
+)
+
+// IsRetriable reports whether err is a transient file I/O failure.
+func IsRetriable(err error) bool {
+	return errors.Is(err, syscall.EAGAIN) ||
+		errors.Is(err, syscall.EINTR) ||
+		errors.Is(err, syscall.EBUSY)
+}
@@ -2,34 +2,73 @@ package file
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	models "github.com/fireflg/ago-musthave-metrics-tpl/internal/model"
 	"github.com/fireflg/ago-musthave-metrics-tpl/internal/repository/memory"
+	"github.com/fireflg/ago-musthave-metrics-tpl/internal/repository/retry"
 	"log"
 	"os"
-	"path/filepath"
 	"sync"
 	"time"
 )
 
+// syncBackupInterval limits how often synchronous writes rotate the snapshot into the backups,
+// so a burst of updates does not replace every backup with nearly identical snapshots.
+const syncBackupInterval = time.Minute
+
 type FileRepository struct {
 	storageInterval int
 	storageRestore  bool
 	storagePath     string
+	backups         int
+	// rotatedAt is when the snapshot was last rotated into the backups, guarded by mu.
+	rotatedAt time.Time
 	memory.MemoryRepository
 	mu sync.Mutex
+
+	// The write-ahead log is used when compactRecords > 0.
+	compactRecords int
+	wal            *os.File
+	walSize        int64
+	walRecords     int
+
+	stopSaver chan struct{}
+	saverDone chan struct{}
+	closeOnce sync.Once
 }
 
+// NewFileRepository keeps metrics in memory and snapshots them to storagePath,
+// keeping the given number of previous snapshots as storagePath.1, storagePath.2 and so on.
 func NewFileRepository(
 	storagePath string,
 	storageInterval int,
 	storageRestore bool,
+	backups int,
 ) *FileRepository {
+	return newFileRepository(storagePath, storageInterval, storageRestore, backups, 0)
+}
+
+// NewFileRepositoryWithWAL appends every update to a write-ahead log next to the snapshot
+// instead of rewriting the snapshot. The log is compacted into the snapshot every
+// compactRecords records and, when storageInterval is set, on every interval.
+func NewFileRepositoryWithWAL(
+	storagePath string,
+	storageInterval int,
+	storageRestore bool,
+	backups int,
+	compactRecords int,
+) *FileRepository {
+	return newFileRepository(storagePath, storageInterval, storageRestore, backups, max(compactRecords, 1))
+}
+
+func newFileRepository(storagePath string, storageInterval int, storageRestore bool, backups int, compactRecords int) *FileRepository {
 	repo := &FileRepository{
 		storagePath:     storagePath,
 		storageInterval: storageInterval,
 		storageRestore:  storageRestore,
+		backups:         backups,
+		compactRecords:  compactRecords,
 		MemoryRepository: memory.MemoryRepository{
 			Metrics: make(map[string]models.Metrics),
 		},
@@ -41,127 +80,286 @@ func NewFileRepository(
 	return repo
 }
 
-func (f *FileRepository) GetCounter(ctx context.Context, name string) (int64, error) {
-	return f.MemoryRepository.GetCounter(ctx, name)
+func (f *FileRepository) GetCounter(ctx context.Context, name string, labels map[string]string) (int64, error) {
+	return f.MemoryRepository.GetCounter(ctx, name, labels)
 }
 
-func (f *FileRepository) GetGauge(ctx context.Context, name string) (float64, error) {
-	return f.MemoryRepository.GetGauge(ctx, name)
+func (f *FileRepository) GetGauge(ctx context.Context, name string, labels map[string]string) (float64, error) {
+	return f.MemoryRepository.GetGauge(ctx, name, labels)
 }
 
 func (f *FileRepository) SetGauge(ctx context.Context, name string, value float64) error {
 	if err := f.MemoryRepository.SetGauge(ctx, name, value); err != nil {
 		return err
 	}
-	if f.storageInterval == 0 {
-		err := f.StoreMetrics()
-		if err != nil {
-			return err
-		}
-	}
-	return nil
+	return f.syncStore(ctx, name)
 }
 
 func (f *FileRepository) SetCounter(ctx context.Context, name string, value int64) error {
 	if err := f.MemoryRepository.SetCounter(ctx, name, value); err != nil {
 		return err
 	}
-	if f.storageInterval == 0 {
-		err := f.StoreMetrics()
-		if err != nil {
-			return err
-		}
-	}
-	return nil
+	return f.syncStore(ctx, name)
 }
 
 func (f *FileRepository) SetMetric(ctx context.Context, metric models.Metrics) error {
 	if err := f.MemoryRepository.SetMetric(ctx, metric); err != nil {
 		return err
 	}
-	if f.storageInterval == 0 {
-		err := f.StoreMetrics()
-		if err != nil {
-			return err
+	return f.syncStore(ctx, metric.Key())
+}
+
+func (f *FileRepository) SetMetrics(ctx context.Context, metrics []models.Metrics) error {
+	if err := f.MemoryRepository.SetMetrics(ctx, metrics); err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(metrics))
+	seen := make(map[string]bool, len(metrics))
+	for _, metric := range metrics {
+		if key := metric.Key(); !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
 		}
 	}
-	return nil
+	return f.syncStore(ctx, keys...)
+}
+
+func (f *FileRepository) Delete(ctx context.Context, metricType string, name string, labels map[string]string) error {
+	key, err := f.MemoryRepository.DeleteSeries(ctx, metricType, name, labels)
+	if err != nil {
+		return err
+	}
+	return f.syncDelete(ctx, key)
+}
+
+func (f *FileRepository) DeleteMetrics(ctx context.Context, metrics []models.Metrics) error {
+	keys, err := f.MemoryRepository.DeleteBatch(ctx, metrics)
+	if err != nil || len(keys) == 0 {
+		return err
+	}
+	return f.syncDelete(ctx, keys...)
+}
+
+func (f *FileRepository) ResetCounter(ctx context.Context, name string, labels map[string]string) error {
+	key, err := f.MemoryRepository.ResetSeries(ctx, name, labels)
+	if err != nil {
+		return err
+	}
+	return f.syncStore(ctx, key)
+}
+
+func (f *FileRepository) History(ctx context.Context, metricType string, name string, labels map[string]string, from, to time.Time) ([]models.Point, error) {
+	return f.MemoryRepository.History(ctx, metricType, name, labels, from, to)
+}
+
+func (f *FileRepository) List(ctx context.Context) ([]models.Metrics, error) {
+	return f.MemoryRepository.List(ctx)
 }
 
 func (f *FileRepository) Ping(ctx context.Context) error {
 	return f.MemoryRepository.Ping(ctx)
 }
 
+// syncStore persists the metrics stored under keys: it appends them to the write-ahead log,
+// or writes the snapshot right away in synchronous mode (storageInterval == 0).
+// Only the write is retried so the in-memory update is never applied twice.
+func (f *FileRepository) syncStore(ctx context.Context, keys ...string) error {
+	if f.compactRecords > 0 {
+		return retry.Do(ctx, retry.DefaultDelays, IsRetriable, func() error {
+			return f.appendWAL(keys, false)
+		})
+	}
+	if f.storageInterval != 0 {
+		return nil
+	}
+	return retry.Do(ctx, retry.DefaultDelays, IsRetriable, f.StoreMetrics)
+}
+
+// syncDelete persists the removal of the metrics stored under keys.
+func (f *FileRepository) syncDelete(ctx context.Context, keys ...string) error {
+	if f.compactRecords > 0 {
+		return retry.Do(ctx, retry.DefaultDelays, IsRetriable, func() error {
+			return f.appendWAL(keys, true)
+		})
+	}
+	return f.syncStore(ctx)
+}
+
+// InitStorage restores the stored metrics, opens the write-ahead log and starts the periodic saver.
+// A failed restore does not prevent the log from being opened or the saver from starting,
+// the errors are returned once the repository is ready for writes.
 func (f *FileRepository) InitStorage() error {
+	var errs []error
 	if f.storageRestore {
-		if err := f.RestoreMetrics(); err != nil {
-			return err
+		if err := retry.Do(context.Background(), retry.DefaultDelays, IsRetriable, f.RestoreMetrics); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if f.compactRecords > 0 {
+		if err := f.initWAL(); err != nil {
+			errs = append(errs, err)
 		}
 	}
 	if f.storageInterval > 0 {
+		f.stopSaver = make(chan struct{})
+		f.saverDone = make(chan struct{})
 		go f.startPeriodicSave()
 	}
-	return nil
+	return errors.Join(errs...)
 }
 
+// startPeriodicSave stores the snapshot every storageInterval until Close is called.
+// Failed saves are logged and retried on the next tick.
 func (f *FileRepository) startPeriodicSave() {
+	defer close(f.saverDone)
+
 	ticker := time.NewTicker(time.Duration(f.storageInterval) * time.Second)
 	defer ticker.Stop()
 
-	for range ticker.C {
-		if err := f.StoreMetrics(); err != nil {
+	for {
+		select {
+		case <-ticker.C:
+			if err := f.StoreMetrics(); err != nil {
+				log.Printf("Periodic save failed: %v", err)
+			}
+		case <-f.stopSaver:
 			return
 		}
 	}
 }
 
+// Close stops the periodic saver, writes the final snapshot and closes the write-ahead log.
+func (f *FileRepository) Close(ctx context.Context) error {
+	var err error
+	f.closeOnce.Do(func() {
+		err = f.close(ctx)
+	})
+	return err
+}
+
+// close runs once, so the final snapshot is written even when waiting for the saver timed out:
+// StoreMetrics takes f.mu and therefore runs after any save still in progress.
+func (f *FileRepository) close(ctx context.Context) error {
+	var errs []error
+	if f.saverDone != nil {
+		close(f.stopSaver)
+		select {
+		case <-f.saverDone:
+		case <-ctx.Done():
+			errs = append(errs, fmt.Errorf("Close: stop periodic save: %w", ctx.Err()))
+		}
+	}
+
+	// Synchronous snapshots are already on disk after every update.
+	if f.storagePath != "" && (f.storageInterval > 0 || f.compactRecords > 0) {
+		if err := retry.Do(ctx, retry.DefaultDelays, IsRetriable, f.StoreMetrics); err != nil {
+			errs = append(errs, fmt.Errorf("Close: %w", err))
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.wal != nil {
+		if err := f.wal.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("Close: close wal: %w", err))
+		}
+		f.wal = nil
+	}
+	return errors.Join(errs...)
+}
+
+// StoreMetrics atomically replaces the snapshot, rotating the previous one into the backups.
+// In WAL mode this compacts the log into the snapshot. In synchronous mode the snapshot is
+// rotated on the first write and then at most once per syncBackupInterval.
 func (f *FileRepository) StoreMetrics() error {
 	f.mu.Lock()
 	defer f.mu.Unlock()
+	return f.storeLocked()
+}
 
-	metrics := f.MemoryRepository.GetAllMetrics()
-	data, err := json.MarshalIndent(metrics, "", "  ")
+// storeLocked writes the snapshot and empties the log it now covers, f.mu must be held.
+func (f *FileRepository) storeLocked() error {
+	data, err := encodeSnapshot(f.MemoryRepository.GetAllMetrics())
 	if err != nil {
-		return fmt.Errorf("StoreMetrics: marshal json: %w", err)
+		return fmt.Errorf("StoreMetrics: %w", err)
 	}
-
-	dir := filepath.Dir(f.storagePath)
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		return fmt.Errorf("StoreMetrics: mkdir: %w", err)
+	backups := f.backups
+	if f.storageInterval == 0 && f.compactRecords == 0 && time.Since(f.rotatedAt) < syncBackupInterval {
+		backups = 0
 	}
-
-	if err := os.WriteFile(f.storagePath, data, 0644); err != nil {
-		return fmt.Errorf("StoreMetrics: write file: %w", err)
+	if err := writeSnapshot(f.storagePath, data, backups); err != nil {
+		return fmt.Errorf("StoreMetrics: %w", err)
+	}
+	if backups > 0 {
+		f.rotatedAt = time.Now()
+	}
+	if err := f.truncateWAL(); err != nil {
+		return fmt.Errorf("StoreMetrics: %w", err)
 	}
-
 	return nil
 }
 
+// initWAL replays the log left by the previous run when restoring, compacts it into
+// the snapshot and opens a fresh log.
+// A failed compaction leaves the replayed records in the log, which is still opened.
+func (f *FileRepository) initWAL() error {
+	if f.storageRestore {
+		if err := f.replayWAL(); err != nil {
+			return err
+		}
+		if err := f.StoreMetrics(); err != nil {
+			return errors.Join(err, f.openWAL())
+		}
+	}
+	return f.openWAL()
+}
+
+// RestoreMetrics loads the snapshot, falling back to the newest valid backup when
+// the snapshot is missing or corrupt.
 func (f *FileRepository) RestoreMetrics() error {
-	ctx := context.Background()
 	if f.storagePath == "" {
 		return nil
 	}
 
-	data, err := os.ReadFile(f.storagePath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil
+	var lastErr error
+	for i := 0; i <= f.backups; i++ {
+		path := f.storagePath
+		if i > 0 {
+			path = backupPath(f.storagePath, i)
 		}
-		return fmt.Errorf("RestoreMetrics: read file: %w", err)
-	}
 
-	var metricsArray map[string]models.Metrics
-	if err := json.Unmarshal(data, &metricsArray); err != nil {
-		return fmt.Errorf("RestoreMetrics: unmarshal json: %w", err)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return fmt.Errorf("RestoreMetrics: read file: %w", err)
+		}
+
+		metrics, err := decodeSnapshot(data)
+		if err != nil {
+			log.Printf("Skipping snapshot %s: %v", path, err)
+			lastErr = fmt.Errorf("RestoreMetrics: %s: %w", path, err)
+			continue
+		}
+
+		if err := f.load(metrics); err != nil {
+			return err
+		}
+		if i > 0 {
+			log.Printf("Restored %d metrics from backup %s", len(metrics), path)
+		}
+		return nil
 	}
+	return lastErr
+}
 
+func (f *FileRepository) load(metrics map[string]models.Metrics) error {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
-	for _, metric := range metricsArray {
-		err := f.MemoryRepository.SetMetric(ctx, metric)
-		if err != nil {
+	for _, metric := range metrics {
+		if err := f.MemoryRepository.Load(metric); err != nil {
 			return err
 		}
 	}
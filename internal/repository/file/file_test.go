@@ -1,9 +1,14 @@
 package file_test
 
 import (
+	"bytes"
 	"context"
+	"fmt"
 	"os"
+	"path/filepath"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 
@@ -15,12 +20,12 @@ func TestFileRepository_SetAndGetGauge(t *testing.T) {
 	assert.NoError(t, err)
 	defer os.Remove(tmpFile.Name())
 
-	repo := file.NewFileRepository(tmpFile.Name(), 0, false)
+	repo := file.NewFileRepository(tmpFile.Name(), 0, false, 0)
 
 	err = repo.SetGauge(context.Background(), "gauge1", 1.23)
 	assert.NoError(t, err)
 
-	val, err := repo.GetGauge(context.Background(), "gauge1")
+	val, err := repo.GetGauge(context.Background(), "gauge1", nil)
 	assert.NoError(t, err)
 	assert.Equal(t, 1.23, val)
 }
@@ -30,18 +35,251 @@ func TestFileRepository_SetAndGetCounter(t *testing.T) {
 	assert.NoError(t, err)
 	defer os.Remove(tmpFile.Name())
 
-	repo := file.NewFileRepository(tmpFile.Name(), 0, false)
+	repo := file.NewFileRepository(tmpFile.Name(), 0, false, 0)
 
 	err = repo.SetCounter(context.Background(), "counter1", 10)
 	assert.NoError(t, err)
 
-	val, err := repo.GetCounter(context.Background(), "counter1")
+	val, err := repo.GetCounter(context.Background(), "counter1", nil)
 	assert.NoError(t, err)
 	assert.Equal(t, int64(10), val)
 }
 
 func TestFileRepository_Ping(t *testing.T) {
-	repo := file.NewFileRepository("", 0, false)
+	repo := file.NewFileRepository("", 0, false, 0)
 	err := repo.Ping(context.Background())
 	assert.NoError(t, err)
 }
+
+func TestFileRepository_DeleteRewritesSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+
+	repo := file.NewFileRepository(path, 0, false, 0)
+	assert.NoError(t, repo.SetGauge(context.Background(), "gauge1", 1.23))
+	assert.NoError(t, repo.SetGauge(context.Background(), "gauge2", 4.56))
+	assert.NoError(t, repo.Delete(context.Background(), "gauge", "gauge1", nil))
+
+	restored := file.NewFileRepository(path, 0, true, 0)
+	_, err := restored.GetGauge(context.Background(), "gauge1", nil)
+	assert.Error(t, err)
+	val, err := restored.GetGauge(context.Background(), "gauge2", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 4.56, val)
+}
+
+func TestFileRepository_RotatesBackups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+
+	// Synchronous writes rotate once per run, not on every update.
+	value := 0.0
+	for run := 1; run <= 3; run++ {
+		repo := file.NewFileRepository(path, 0, true, 2)
+		for i := 0; i < 2; i++ {
+			value++
+			assert.NoError(t, repo.SetGauge(context.Background(), "gauge1", value))
+		}
+	}
+
+	assert.FileExists(t, path+".1")
+	assert.FileExists(t, path+".2")
+	assert.NoFileExists(t, path+".3")
+
+	for i, want := range []float64{4, 2} {
+		backup := file.NewFileRepository(fmt.Sprintf("%s.%d", path, i+1), 0, true, 0)
+		val, err := backup.GetGauge(context.Background(), "gauge1", nil)
+		assert.NoError(t, err)
+		assert.Equal(t, want, val)
+	}
+}
+
+func TestFileRepository_RestoreFallsBackToBackup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+
+	repo := file.NewFileRepository(path, 0, false, 2)
+	assert.NoError(t, repo.SetGauge(context.Background(), "gauge1", 1.5))
+	repo = file.NewFileRepository(path, 0, true, 2)
+	assert.NoError(t, repo.SetGauge(context.Background(), "gauge1", 2.5))
+
+	// Simulate a torn write of the live snapshot.
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(path, data[:len(data)/2], 0644))
+
+	restored := file.NewFileRepository(path, 0, true, 2)
+	val, err := restored.GetGauge(context.Background(), "gauge1", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 1.5, val)
+}
+
+func TestFileRepository_RestoreDetectsChecksumMismatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+
+	repo := file.NewFileRepository(path, 0, false, 0)
+	assert.NoError(t, repo.SetGauge(context.Background(), "gauge1", 1.5))
+
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(path, bytes.Replace(data, []byte("1.5"), []byte("9.5"), 1), 0644))
+
+	err = file.NewFileRepository(path, 0, false, 0).RestoreMetrics()
+	assert.ErrorIs(t, err, file.ErrCorruptSnapshot)
+}
+
+func TestFileRepository_RestoresLegacySnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	legacy := `{"gauge1": {"id": "gauge1", "type": "gauge", "value": 4.56}}`
+	assert.NoError(t, os.WriteFile(path, []byte(legacy), 0644))
+
+	restored := file.NewFileRepository(path, 0, true, 0)
+	val, err := restored.GetGauge(context.Background(), "gauge1", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 4.56, val)
+}
+
+func TestFileRepository_WALReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+
+	repo := file.NewFileRepositoryWithWAL(path, 0, false, 0, 100)
+	assert.NoError(t, repo.SetCounter(context.Background(), "counter1", 2))
+	assert.NoError(t, repo.SetCounter(context.Background(), "counter1", 3))
+	assert.NoError(t, repo.SetGauge(context.Background(), "gauge1", 1.23))
+	assert.NoError(t, repo.Delete(context.Background(), "gauge", "gauge1", nil))
+
+	assert.NoFileExists(t, path)
+	data, err := os.ReadFile(path + ".wal")
+	assert.NoError(t, err)
+	assert.Equal(t, 4, bytes.Count(data, []byte{'\n'}))
+
+	restored := file.NewFileRepositoryWithWAL(path, 0, true, 0, 100)
+	val, err := restored.GetCounter(context.Background(), "counter1", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), val)
+	_, err = restored.GetGauge(context.Background(), "gauge1", nil)
+	assert.Error(t, err)
+}
+
+func TestFileRepository_WALCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+
+	repo := file.NewFileRepositoryWithWAL(path, 0, false, 0, 2)
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, repo.SetCounter(context.Background(), "counter1", 1))
+	}
+
+	assert.FileExists(t, path)
+	data, err := os.ReadFile(path + ".wal")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, bytes.Count(data, []byte{'\n'}))
+
+	restored := file.NewFileRepositoryWithWAL(path, 0, true, 0, 2)
+	val, err := restored.GetCounter(context.Background(), "counter1", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), val)
+}
+
+func TestFileRepository_WALIgnoresTornTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+
+	repo := file.NewFileRepositoryWithWAL(path, 0, false, 0, 100)
+	assert.NoError(t, repo.SetCounter(context.Background(), "counter1", 4))
+
+	wal, err := os.OpenFile(path+".wal", os.O_WRONLY|os.O_APPEND, 0644)
+	assert.NoError(t, err)
+	_, err = wal.WriteString(`{"op":"set","metric":{"id":"counter1","ty`)
+	assert.NoError(t, err)
+	assert.NoError(t, wal.Close())
+
+	restored := file.NewFileRepositoryWithWAL(path, 0, true, 0, 100)
+	val, err := restored.GetCounter(context.Background(), "counter1", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4), val)
+}
+
+func TestFileRepository_WALReplayAfterCorruptSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+
+	repo := file.NewFileRepositoryWithWAL(path, 0, false, 0, 100)
+	assert.NoError(t, repo.SetCounter(context.Background(), "counter1", 4))
+	assert.NoError(t, os.WriteFile(path, []byte("garbage"), 0644))
+
+	restored := file.NewFileRepositoryWithWAL(path, 0, true, 0, 100)
+	val, err := restored.GetCounter(context.Background(), "counter1", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4), val)
+	assert.NoError(t, restored.SetCounter(context.Background(), "counter1", 1))
+
+	again := file.NewFileRepositoryWithWAL(path, 0, true, 0, 100)
+	val, err = again.GetCounter(context.Background(), "counter1", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), val)
+}
+
+func TestFileRepository_PeriodicSaveAfterCorruptSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	assert.NoError(t, os.WriteFile(path, []byte("garbage"), 0644))
+
+	repo := file.NewFileRepository(path, 1, true, 0)
+	defer repo.Close(context.Background())
+	assert.NoError(t, repo.SetGauge(context.Background(), "gauge1", 1.23))
+
+	assert.Eventually(t, func() bool {
+		val, err := file.NewFileRepository(path, 0, true, 0).GetGauge(context.Background(), "gauge1", nil)
+		return err == nil && val == 1.23
+	}, 3*time.Second, 100*time.Millisecond)
+}
+
+func TestFileRepository_CloseStoresPendingMetrics(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+
+	repo := file.NewFileRepository(path, 3600, false, 0)
+	assert.NoError(t, repo.SetGauge(context.Background(), "gauge1", 1.23))
+	assert.NoFileExists(t, path)
+
+	assert.NoError(t, repo.Close(context.Background()))
+	assert.NoError(t, repo.Close(context.Background()))
+
+	restored := file.NewFileRepository(path, 0, true, 0)
+	val, err := restored.GetGauge(context.Background(), "gauge1", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 1.23, val)
+}
+
+func TestFileRepository_CloseStoresAfterTimeout(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+
+	repo := file.NewFileRepository(path, 3600, false, 0)
+	assert.NoError(t, repo.SetGauge(context.Background(), "gauge1", 1.23))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	repo.Close(ctx)
+
+	restored := file.NewFileRepository(path, 0, true, 0)
+	val, err := restored.GetGauge(context.Background(), "gauge1", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 1.23, val)
+}
+
+func TestFileRepository_CloseCompactsWAL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+
+	repo := file.NewFileRepositoryWithWAL(path, 0, false, 0, 100)
+	assert.NoError(t, repo.SetCounter(context.Background(), "counter1", 7))
+	assert.NoError(t, repo.Close(context.Background()))
+
+	data, err := os.ReadFile(path + ".wal")
+	assert.NoError(t, err)
+	assert.Empty(t, data)
+
+	restored := file.NewFileRepository(path, 0, true, 0)
+	val, err := restored.GetCounter(context.Background(), "counter1", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(7), val)
+}
+
+func TestIsRetriable(t *testing.T) {
+	assert.True(t, file.IsRetriable(&os.PathError{Op: "write", Path: "metrics.json", Err: syscall.EAGAIN}))
+	assert.True(t, file.IsRetriable(fmt.Errorf("StoreMetrics: write file: %w", &os.PathError{Op: "write", Err: syscall.EINTR})))
+	assert.False(t, file.IsRetriable(&os.PathError{Op: "open", Path: "metrics.json", Err: syscall.EACCES}))
+	assert.False(t, file.IsRetriable(os.ErrNotExist))
+}
@@ -0,0 +1,142 @@
+package file
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	models "github.com/fireflg/ago-musthave-metrics-tpl/internal/model"
+)
+
+// snapshotVersion is written to the header of every snapshot.
+const snapshotVersion = 1
+
+// ErrCorruptSnapshot is returned for snapshots whose checksum or encoding is invalid.
+var ErrCorruptSnapshot = errors.New("corrupt snapshot")
+
+// snapshotHeader is the first line of a snapshot, the checksum covers the JSON body after it.
+type snapshotHeader struct {
+	Version int    `json:"version"`
+	SHA256  string `json:"sha256"`
+}
+
+func encodeSnapshot(metrics map[string]models.Metrics) ([]byte, error) {
+	body, err := json.MarshalIndent(metrics, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("marshal json: %w", err)
+	}
+
+	sum := sha256.Sum256(body)
+	header, err := json.Marshal(snapshotHeader{Version: snapshotVersion, SHA256: hex.EncodeToString(sum[:])})
+	if err != nil {
+		return nil, fmt.Errorf("marshal header: %w", err)
+	}
+
+	data := make([]byte, 0, len(header)+1+len(body))
+	data = append(data, header...)
+	data = append(data, '\n')
+	return append(data, body...), nil
+}
+
+// decodeSnapshot verifies and decodes a snapshot. Files without a header are read as
+// the plain JSON written by earlier versions.
+func decodeSnapshot(data []byte) (map[string]models.Metrics, error) {
+	body := data
+	line, rest, found := bytes.Cut(data, []byte{'\n'})
+	var header snapshotHeader
+	if found && json.Unmarshal(line, &header) == nil && header.Version > 0 {
+		if header.Version > snapshotVersion {
+			return nil, fmt.Errorf("unsupported snapshot version %d", header.Version)
+		}
+		sum := sha256.Sum256(rest)
+		if hex.EncodeToString(sum[:]) != header.SHA256 {
+			return nil, fmt.Errorf("%w: checksum mismatch", ErrCorruptSnapshot)
+		}
+		body = rest
+	}
+
+	var metrics map[string]models.Metrics
+	if err := json.Unmarshal(body, &metrics); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorruptSnapshot, err)
+	}
+	return metrics, nil
+}
+
+// backupPath returns the path of the n-th previous snapshot, 1 being the newest.
+func backupPath(path string, n int) string {
+	return fmt.Sprintf("%s.%d", path, n)
+}
+
+// writeSnapshot atomically replaces path with data: the data is written and synced to a
+// temporary file in the same directory, the previous snapshots are rotated and the temporary
+// file is renamed over path.
+func writeSnapshot(path string, data []byte, backups int) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("mkdir: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("create temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write temp file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("sync temp file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close temp file: %w", err)
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return fmt.Errorf("chmod temp file: %w", err)
+	}
+
+	if err := rotateBackups(path, backups); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("rename temp file: %w", err)
+	}
+	return syncDir(dir)
+}
+
+// rotateBackups shifts path.1 .. path.(n-1) up by one and moves path to path.1.
+func rotateBackups(path string, backups int) error {
+	if backups <= 0 {
+		return nil
+	}
+	for i := backups - 1; i >= 0; i-- {
+		from := path
+		if i > 0 {
+			from = backupPath(path, i)
+		}
+		if err := os.Rename(from, backupPath(path, i+1)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("rotate backup: %w", err)
+		}
+	}
+	return nil
+}
+
+// syncDir persists the directory entries changed by a rename.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("open dir: %w", err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("sync dir: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package file
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+
+	models "github.com/fireflg/ago-musthave-metrics-tpl/internal/model"
+)
+
+const (
+	walOpSet    = "set"
+	walOpDelete = "delete"
+)
+
+// walRecord is a single line of the write-ahead log. Set records carry the stored state
+// of the metric rather than the update, so replaying a record twice is harmless.
+type walRecord struct {
+	Op     string          `json:"op"`
+	Key    string          `json:"key,omitempty"`
+	Metric *models.Metrics `json:"metric,omitempty"`
+}
+
+// walPath returns the path of the write-ahead log kept next to the snapshot.
+func walPath(storagePath string) string {
+	return storagePath + ".wal"
+}
+
+// openWAL opens an empty log, any previous content must already be replayed and compacted.
+func (f *FileRepository) openWAL() error {
+	file, err := os.OpenFile(walPath(f.storagePath), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("open wal: %w", err)
+	}
+	f.wal = file
+	f.walSize = 0
+	f.walRecords = 0
+	return nil
+}
+
+// appendWAL writes records for the given keys with their current state and syncs the log.
+// Keys missing from memory are logged as deletions. The log is compacted every
+// compactRecords records.
+func (f *FileRepository) appendWAL(keys []string, deleted bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.wal == nil {
+		return fmt.Errorf("appendWAL: wal is not open")
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, key := range keys {
+		record := walRecord{Op: walOpDelete, Key: key}
+		if !deleted {
+			if metric, ok := f.MemoryRepository.Get(key); ok {
+				record = walRecord{Op: walOpSet, Metric: &metric}
+			}
+		}
+		if err := enc.Encode(record); err != nil {
+			return fmt.Errorf("appendWAL: marshal json: %w", err)
+		}
+	}
+
+	if _, err := f.wal.WriteAt(buf.Bytes(), f.walSize); err != nil {
+		// Drop a partially written tail so that a retry starts on a clean line.
+		_ = f.wal.Truncate(f.walSize)
+		return fmt.Errorf("appendWAL: write: %w", err)
+	}
+	if err := f.wal.Sync(); err != nil {
+		_ = f.wal.Truncate(f.walSize)
+		return fmt.Errorf("appendWAL: sync: %w", err)
+	}
+	f.walSize += int64(buf.Len())
+	f.walRecords += len(keys)
+
+	if f.walRecords >= f.compactRecords {
+		if err := f.storeLocked(); err != nil {
+			log.Printf("WAL compaction failed: %v", err)
+		}
+	}
+	return nil
+}
+
+// truncateWAL empties the log once its records are part of a snapshot, f.mu must be held.
+func (f *FileRepository) truncateWAL() error {
+	if f.wal == nil {
+		return nil
+	}
+	if err := f.wal.Truncate(0); err != nil {
+		return fmt.Errorf("truncate wal: %w", err)
+	}
+	if err := f.wal.Sync(); err != nil {
+		return fmt.Errorf("sync wal: %w", err)
+	}
+	f.walSize = 0
+	f.walRecords = 0
+	return nil
+}
+
+// replayWAL applies the log on top of the restored snapshot. A record that cannot be
+// decoded ends the replay, it is the torn tail of a write interrupted by a crash.
+func (f *FileRepository) replayWAL() error {
+	file, err := os.Open(walPath(f.storagePath))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("replayWAL: open: %w", err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	applied := 0
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) == 0 && err != nil {
+			break
+		}
+
+		var record walRecord
+		if err != nil || json.Unmarshal(line, &record) != nil {
+			log.Printf("Ignoring torn WAL record after %d records", applied)
+			break
+		}
+
+		switch {
+		case record.Op == walOpSet && record.Metric != nil:
+			if err := f.MemoryRepository.Load(*record.Metric); err != nil {
+				return fmt.Errorf("replayWAL: record %d: %w", applied+1, err)
+			}
+		case record.Op == walOpDelete:
+			f.MemoryRepository.Unload(record.Key)
+		default:
+			return fmt.Errorf("replayWAL: record %d: unknown op %q", applied+1, record.Op)
+		}
+		applied++
+	}
+
+	if applied > 0 {
+		log.Printf("Replayed %d WAL records", applied)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	models "github.com/fireflg/ago-musthave-metrics-tpl/internal/model"
+)
+
+// ring keeps the last len(points) history points of a metric.
+type ring struct {
+	points []models.Point
+	next   int
+	full   bool
+}
+
+func newRing(size int) *ring {
+	return &ring{points: make([]models.Point, size)}
+}
+
+func (r *ring) add(point models.Point) {
+	r.points[r.next] = point
+	r.next = (r.next + 1) % len(r.points)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// between returns points with from <= Timestamp <= to, oldest first.
+func (r *ring) between(from, to time.Time) []models.Point {
+	ordered := r.points[:r.next]
+	if r.full {
+		ordered = append(append([]models.Point{}, r.points[r.next:]...), r.points[:r.next]...)
+	}
+
+	result := make([]models.Point, 0, len(ordered))
+	for _, point := range ordered {
+		if point.Timestamp.Before(from) || point.Timestamp.After(to) {
+			continue
+		}
+		result = append(result, point)
+	}
+	return result
+}
+
+// EnableHistory makes the repository keep the last size values of every metric.
+func (m *MemoryRepository) EnableHistory(size int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.historySize = size
+	m.history = make(map[string]*ring)
+}
+
+// record appends the current value of metric to its history, m.mu must be held by the caller.
+func (m *MemoryRepository) record(metric models.Metrics) {
+	if m.historySize <= 0 {
+		return
+	}
+
+	point := models.Point{Timestamp: time.Now()}
+	switch {
+	case metric.Value != nil:
+		point.Value = *metric.Value
+	case metric.Delta != nil:
+		point.Value = float64(*metric.Delta)
+	}
+
+	key := metric.MType + "/" + metric.Key()
+	r, ok := m.history[key]
+	if !ok {
+		r = newRing(m.historySize)
+		m.history[key] = r
+	}
+	r.add(point)
+}
+
+func (m *MemoryRepository) History(ctx context.Context, metricType string, name string, labels map[string]string, from, to time.Time) ([]models.Point, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("operation canceled: %w", err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.historySize <= 0 {
+		return nil, models.ErrHistoryDisabled
+	}
+	key, _, err := m.resolve(metricType, name, labels)
+	if err != nil {
+		return nil, err
+	}
+	r, ok := m.history[metricType+"/"+key]
+	if !ok {
+		return []models.Point{}, nil
+	}
+	return r.between(from, to), nil
+}
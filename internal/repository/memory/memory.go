@@ -5,12 +5,16 @@ import (
 	"errors"
 	"fmt"
 	models "github.com/fireflg/ago-musthave-metrics-tpl/internal/model"
+	"sort"
 	"sync"
+	"time"
 )
 
 type MemoryRepository struct {
-	Metrics map[string]models.Metrics
-	mu      sync.Mutex
+	Metrics     map[string]models.Metrics
+	mu          sync.Mutex
+	historySize int
+	history     map[string]*ring
 }
 
 func NewMemoryRepository() models.MetricsRepository {
@@ -19,6 +23,15 @@ func NewMemoryRepository() models.MetricsRepository {
 	}
 }
 
+// NewMemoryRepositoryWithHistory creates a repository keeping the last historySize values of every metric.
+func NewMemoryRepositoryWithHistory(historySize int) models.MetricsRepository {
+	repo := &MemoryRepository{
+		Metrics: make(map[string]models.Metrics),
+	}
+	repo.EnableHistory(historySize)
+	return repo
+}
+
 func (m *MemoryRepository) SetGauge(ctx context.Context, name string, value float64) error {
 	if err := ctx.Err(); err != nil {
 		return fmt.Errorf("operation canceled: %w", err)
@@ -36,7 +49,7 @@ func (m *MemoryRepository) SetGauge(ctx context.Context, name string, value floa
 	metric.Delta = nil
 	metric.Value = &value
 
-	m.Metrics[name] = metric
+	m.store(name, metric)
 	return nil
 }
 
@@ -63,7 +76,7 @@ func (m *MemoryRepository) SetCounter(ctx context.Context, name string, value in
 	metric.Delta = &delta
 	metric.Value = nil
 
-	m.Metrics[name] = metric
+	m.store(name, metric)
 	return nil
 }
 
@@ -75,17 +88,46 @@ func (m *MemoryRepository) SetMetric(ctx context.Context, metric models.Metrics)
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	return m.applyMetric(metric)
+}
+
+// SetMetrics validates the whole batch first and then applies it under a single lock,
+// so either every metric is stored or none.
+func (m *MemoryRepository) SetMetrics(ctx context.Context, metrics []models.Metrics) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("operation canceled: %w", err)
+	}
+	for _, metric := range metrics {
+		if err := metric.Validate(); err != nil {
+			return err
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, metric := range metrics {
+		if err := m.applyMetric(metric); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyMetric stores a single metric, m.mu must be held by the caller.
+func (m *MemoryRepository) applyMetric(metric models.Metrics) error {
 	switch metric.MType {
 	case "counter":
 		if metric.Delta == nil {
 			return fmt.Errorf("counter metric delta is nil")
 		}
 
-		existing, exists := m.Metrics[metric.ID]
+		existing, exists := m.Metrics[metric.Key()]
 		if !exists {
 			existing = models.Metrics{
-				ID:    metric.ID,
-				MType: "counter",
+				ID:     metric.ID,
+				MType:  "counter",
+				Labels: metric.Labels,
 			}
 		}
 
@@ -95,22 +137,24 @@ func (m *MemoryRepository) SetMetric(ctx context.Context, metric models.Metrics)
 		}
 
 		current += *metric.Delta
+		existing.MType = "counter"
 		existing.Delta = &current
 		existing.Value = nil
 
-		m.Metrics[metric.ID] = existing
+		m.store(metric.Key(), existing)
 
 	case "gauge":
 		if metric.Value == nil {
 			return fmt.Errorf("gauge metric value is nil")
 		}
 
-		m.Metrics[metric.ID] = models.Metrics{
-			ID:    metric.ID,
-			MType: "gauge",
-			Value: metric.Value,
-			Delta: nil,
-		}
+		m.store(metric.Key(), models.Metrics{
+			ID:     metric.ID,
+			MType:  "gauge",
+			Value:  metric.Value,
+			Delta:  nil,
+			Labels: metric.Labels,
+		})
 
 	default:
 		return fmt.Errorf("unknown metric type: %s", metric.MType)
@@ -119,7 +163,29 @@ func (m *MemoryRepository) SetMetric(ctx context.Context, metric models.Metrics)
 	return nil
 }
 
-func (m *MemoryRepository) GetCounter(ctx context.Context, name string) (int64, error) {
+// store saves metric under key with the current update time, m.mu must be held by the caller.
+func (m *MemoryRepository) store(key string, metric models.Metrics) {
+	metric.UpdatedAt = time.Now()
+	m.Metrics[key] = metric
+	m.record(metric)
+}
+
+// Load stores a previously persisted metric as is, keeping its update time.
+func (m *MemoryRepository) Load(metric models.Metrics) error {
+	if err := metric.Validate(); err != nil {
+		return err
+	}
+	if metric.UpdatedAt.IsZero() {
+		metric.UpdatedAt = time.Now()
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Metrics[metric.Key()] = copyMetric(metric)
+	return nil
+}
+
+func (m *MemoryRepository) GetCounter(ctx context.Context, name string, labels map[string]string) (int64, error) {
 
 	if err := ctx.Err(); err != nil {
 		return 0, fmt.Errorf("operation canceled: %w", err)
@@ -128,9 +194,9 @@ func (m *MemoryRepository) GetCounter(ctx context.Context, name string) (int64,
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	metric, exists := m.Metrics[name]
-	if !exists {
-		return 0, errors.New("metric not found")
+	_, metric, err := m.resolve(models.Counter, name, labels)
+	if err != nil {
+		return 0, err
 	}
 
 	if metric.Delta == nil {
@@ -139,16 +205,16 @@ func (m *MemoryRepository) GetCounter(ctx context.Context, name string) (int64,
 	return *metric.Delta, nil
 }
 
-func (m *MemoryRepository) GetGauge(ctx context.Context, name string) (float64, error) {
+func (m *MemoryRepository) GetGauge(ctx context.Context, name string, labels map[string]string) (float64, error) {
 	if err := ctx.Err(); err != nil {
 		return 0, fmt.Errorf("operation canceled: %w", err)
 	}
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	metric, exists := m.Metrics[name]
-	if !exists {
-		return 0, errors.New("metric not found")
+	_, metric, err := m.resolve(models.Gauge, name, labels)
+	if err != nil {
+		return 0, err
 	}
 
 	if metric.Value == nil {
@@ -162,6 +228,192 @@ func (m *MemoryRepository) Ping(ctx context.Context) error {
 	return nil
 }
 
+func (m *MemoryRepository) Close(ctx context.Context) error {
+	return nil
+}
+
+func (m *MemoryRepository) Delete(ctx context.Context, metricType string, name string, labels map[string]string) error {
+	_, err := m.DeleteSeries(ctx, metricType, name, labels)
+	return err
+}
+
+// DeleteSeries works like Delete and returns the key of the removed series.
+func (m *MemoryRepository) DeleteSeries(ctx context.Context, metricType string, name string, labels map[string]string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", fmt.Errorf("operation canceled: %w", err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key, _, err := m.resolve(metricType, name, labels)
+	if err != nil {
+		return "", err
+	}
+	delete(m.Metrics, key)
+	delete(m.history, metricType+"/"+key)
+	return key, nil
+}
+
+func (m *MemoryRepository) DeleteMetrics(ctx context.Context, metrics []models.Metrics) error {
+	_, err := m.DeleteBatch(ctx, metrics)
+	return err
+}
+
+// DeleteBatch works like DeleteMetrics and returns the keys of the removed series.
+// Every series is resolved before the first one is removed.
+func (m *MemoryRepository) DeleteBatch(ctx context.Context, metrics []models.Metrics) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("operation canceled: %w", err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var keys []string
+	types := make(map[string]string, len(metrics))
+	for _, metric := range metrics {
+		if metric.MType != models.Gauge && metric.MType != models.Counter {
+			return nil, fmt.Errorf("unknown metric type: %s", metric.MType)
+		}
+		key, _, err := m.resolve(metric.MType, metric.ID, metric.Labels)
+		if errors.Is(err, models.ErrMetricNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := types[key]; !ok {
+			types[key] = metric.MType
+			keys = append(keys, key)
+		}
+	}
+	for _, key := range keys {
+		delete(m.Metrics, key)
+		delete(m.history, types[key]+"/"+key)
+	}
+	return keys, nil
+}
+
+func (m *MemoryRepository) ResetCounter(ctx context.Context, name string, labels map[string]string) error {
+	_, err := m.ResetSeries(ctx, name, labels)
+	return err
+}
+
+// ResetSeries works like ResetCounter and returns the key of the reset series.
+func (m *MemoryRepository) ResetSeries(ctx context.Context, name string, labels map[string]string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", fmt.Errorf("operation canceled: %w", err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key, metric, err := m.resolve(models.Counter, name, labels)
+	if err != nil {
+		return "", err
+	}
+	var zero int64
+	metric.Delta = &zero
+	m.store(key, metric)
+	return key, nil
+}
+
+// resolve finds the series of the given type selected by name and labels, see
+// models.MetricsRepository. m.mu must be held by the caller.
+func (m *MemoryRepository) resolve(metricType string, name string, labels map[string]string) (string, models.Metrics, error) {
+	key := name + models.LabelsKey(labels)
+	if metric, ok := m.Metrics[key]; ok && metric.MType == metricType {
+		return key, metric, nil
+	}
+	if len(labels) > 0 {
+		return "", models.Metrics{}, models.ErrMetricNotFound
+	}
+
+	var (
+		found  string
+		series int
+	)
+	for k, metric := range m.Metrics {
+		if metric.ID == name && metric.MType == metricType {
+			found = k
+			series++
+		}
+	}
+	switch series {
+	case 0:
+		return "", models.Metrics{}, models.ErrMetricNotFound
+	case 1:
+		return found, m.Metrics[found], nil
+	default:
+		return "", models.Metrics{}, models.ErrAmbiguousMetric
+	}
+}
+
+// List returns a copy of all stored metrics sorted by ID and labels.
+func (m *MemoryRepository) List(ctx context.Context) ([]models.Metrics, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("operation canceled: %w", err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	result := make([]models.Metrics, 0, len(m.Metrics))
+	for _, metric := range m.Metrics {
+		result = append(result, copyMetric(metric))
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].ID != result[j].ID {
+			return result[i].ID < result[j].ID
+		}
+		return models.LabelsKey(result[i].Labels) < models.LabelsKey(result[j].Labels)
+	})
+	return result, nil
+}
+
+// Get returns a copy of the metric stored under key.
+func (m *MemoryRepository) Get(key string) (models.Metrics, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	metric, ok := m.Metrics[key]
+	if !ok {
+		return models.Metrics{}, false
+	}
+	return copyMetric(metric), true
+}
+
+// Unload removes the metric stored under key, the counterpart of Load.
+func (m *MemoryRepository) Unload(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.Metrics, key)
+}
+
+// GetAllMetrics returns a copy of the stored metrics keyed by ID and labels.
 func (m *MemoryRepository) GetAllMetrics() map[string]models.Metrics {
-	return m.Metrics
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	result := make(map[string]models.Metrics, len(m.Metrics))
+	for name, metric := range m.Metrics {
+		result[name] = copyMetric(metric)
+	}
+	return result
+}
+
+func copyMetric(metric models.Metrics) models.Metrics {
+	if metric.Delta != nil {
+		delta := *metric.Delta
+		metric.Delta = &delta
+	}
+	if metric.Value != nil {
+		value := *metric.Value
+		metric.Value = &value
+	}
+	if metric.Labels != nil {
+		labels := make(map[string]string, len(metric.Labels))
+		for name, value := range metric.Labels {
+			labels[name] = value
+		}
+		metric.Labels = labels
+	}
+	return metric
 }
@@ -3,7 +3,9 @@ package memory_test
 import (
 	"context"
 	"testing"
+	"time"
 
+	models "github.com/fireflg/ago-musthave-metrics-tpl/internal/model"
 	"github.com/stretchr/testify/assert"
 
 	"github.com/fireflg/ago-musthave-metrics-tpl/internal/repository/memory"
@@ -15,7 +17,7 @@ func TestMemoryRepository_SetAndGetGauge(t *testing.T) {
 	err := repo.SetGauge(context.Background(), "gauge1", 1.23)
 	assert.NoError(t, err)
 
-	val, err := repo.GetGauge(context.Background(), "gauge1")
+	val, err := repo.GetGauge(context.Background(), "gauge1", nil)
 	assert.NoError(t, err)
 	assert.Equal(t, 1.23, val)
 }
@@ -29,7 +31,7 @@ func TestMemoryRepository_SetAndGetCounter(t *testing.T) {
 	err = repo.SetCounter(context.Background(), "counter1", 5)
 	assert.NoError(t, err)
 
-	val, err := repo.GetCounter(context.Background(), "counter1")
+	val, err := repo.GetCounter(context.Background(), "counter1", nil)
 	assert.NoError(t, err)
 	assert.Equal(t, int64(15), val)
 }
@@ -37,9 +39,241 @@ func TestMemoryRepository_SetAndGetCounter(t *testing.T) {
 func TestMemoryRepository_GetMissingMetric(t *testing.T) {
 	repo := memory.NewMemoryRepository()
 
-	_, err := repo.GetGauge(context.Background(), "unknown")
+	_, err := repo.GetGauge(context.Background(), "unknown", nil)
 	assert.Error(t, err)
 
-	_, err = repo.GetCounter(context.Background(), "unknown")
+	_, err = repo.GetCounter(context.Background(), "unknown", nil)
 	assert.Error(t, err)
 }
+
+func TestMemoryRepository_List(t *testing.T) {
+	repo := memory.NewMemoryRepository()
+
+	assert.NoError(t, repo.SetGauge(context.Background(), "b", 1.5))
+	assert.NoError(t, repo.SetCounter(context.Background(), "a", 3))
+
+	metrics, err := repo.List(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, metrics, 2)
+	assert.Equal(t, "a", metrics[0].ID)
+	assert.Equal(t, int64(3), *metrics[0].Delta)
+	assert.Equal(t, "b", metrics[1].ID)
+	assert.Equal(t, 1.5, *metrics[1].Value)
+
+	*metrics[0].Delta = 100
+	val, err := repo.GetCounter(context.Background(), "a", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), val)
+}
+
+func TestMemoryRepository_DeleteAndReset(t *testing.T) {
+	repo := memory.NewMemoryRepository()
+
+	assert.NoError(t, repo.SetGauge(context.Background(), "gauge1", 1.23))
+	assert.NoError(t, repo.SetCounter(context.Background(), "counter1", 10))
+
+	assert.ErrorIs(t, repo.Delete(context.Background(), "counter", "gauge1", nil), models.ErrMetricNotFound)
+	assert.NoError(t, repo.Delete(context.Background(), "gauge", "gauge1", nil))
+	_, err := repo.GetGauge(context.Background(), "gauge1", nil)
+	assert.ErrorIs(t, err, models.ErrMetricNotFound)
+
+	assert.NoError(t, repo.ResetCounter(context.Background(), "counter1", nil))
+	val, err := repo.GetCounter(context.Background(), "counter1", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), val)
+
+	assert.ErrorIs(t, repo.ResetCounter(context.Background(), "unknown", nil), models.ErrMetricNotFound)
+}
+
+func TestMemoryRepository_DeleteMetricsIsAtomic(t *testing.T) {
+	repo := memory.NewMemoryRepository()
+
+	value := 1.0
+	assert.NoError(t, repo.SetGauge(context.Background(), "gauge1", 1.23))
+	assert.NoError(t, repo.SetMetrics(context.Background(), []models.Metrics{
+		{ID: "gauge2", MType: "gauge", Value: &value, Labels: map[string]string{"host": "a"}},
+		{ID: "gauge2", MType: "gauge", Value: &value, Labels: map[string]string{"host": "b"}},
+	}))
+
+	err := repo.DeleteMetrics(context.Background(), []models.Metrics{
+		{ID: "gauge1", MType: "gauge"},
+		{ID: "gauge2", MType: "gauge"},
+	})
+	assert.ErrorIs(t, err, models.ErrAmbiguousMetric)
+	_, err = repo.GetGauge(context.Background(), "gauge1", nil)
+	assert.NoError(t, err)
+
+	err = repo.DeleteMetrics(context.Background(), []models.Metrics{
+		{ID: "gauge1", MType: "gauge"},
+		{ID: "missing", MType: "counter"},
+		{ID: "gauge2", MType: "gauge", Labels: map[string]string{"host": "a"}},
+	})
+	assert.NoError(t, err)
+	_, err = repo.GetGauge(context.Background(), "gauge1", nil)
+	assert.ErrorIs(t, err, models.ErrMetricNotFound)
+	val, err := repo.GetGauge(context.Background(), "gauge2", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 1.0, val)
+}
+
+func TestMemoryRepository_SetMetricsIsAtomic(t *testing.T) {
+	repo := memory.NewMemoryRepository()
+
+	delta := int64(5)
+	value := 1.5
+	err := repo.SetMetrics(context.Background(), []models.Metrics{
+		{ID: "counter1", MType: "counter", Delta: &delta},
+		{ID: "gauge1", MType: "gauge"},
+	})
+	assert.Error(t, err)
+
+	_, err = repo.GetCounter(context.Background(), "counter1", nil)
+	assert.ErrorIs(t, err, models.ErrMetricNotFound)
+
+	err = repo.SetMetrics(context.Background(), []models.Metrics{
+		{ID: "counter1", MType: "counter", Delta: &delta},
+		{ID: "counter1", MType: "counter", Delta: &delta},
+		{ID: "gauge1", MType: "gauge", Value: &value},
+	})
+	assert.NoError(t, err)
+
+	val, err := repo.GetCounter(context.Background(), "counter1", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(10), val)
+}
+
+func TestMemoryRepository_SetMetricsTypeChange(t *testing.T) {
+	repo := memory.NewMemoryRepository()
+
+	delta1, delta2 := int64(2), int64(3)
+	value := 1.5
+	assert.NoError(t, repo.SetMetrics(context.Background(), []models.Metrics{
+		{ID: "Alloc", MType: "counter", Delta: &delta1},
+		{ID: "Alloc", MType: "gauge", Value: &value},
+		{ID: "PollCount", MType: "gauge", Value: &value},
+		{ID: "PollCount", MType: "counter", Delta: &delta2},
+	}))
+
+	gauge, err := repo.GetGauge(context.Background(), "Alloc", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 1.5, gauge)
+	counter, err := repo.GetCounter(context.Background(), "PollCount", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), counter)
+}
+
+func TestMemoryRepository_History(t *testing.T) {
+	repo := memory.NewMemoryRepositoryWithHistory(3)
+	from := time.Now().Add(-time.Minute)
+
+	for i := 1; i <= 5; i++ {
+		assert.NoError(t, repo.SetGauge(context.Background(), "gauge1", float64(i)))
+	}
+	assert.NoError(t, repo.SetCounter(context.Background(), "counter1", 2))
+	assert.NoError(t, repo.SetCounter(context.Background(), "counter1", 3))
+
+	points, err := repo.History(context.Background(), "gauge", "gauge1", nil, from, time.Now())
+	assert.NoError(t, err)
+	assert.Len(t, points, 3)
+	assert.Equal(t, []float64{3, 4, 5}, []float64{points[0].Value, points[1].Value, points[2].Value})
+
+	points, err = repo.History(context.Background(), "counter", "counter1", nil, from, time.Now())
+	assert.NoError(t, err)
+	assert.Len(t, points, 2)
+	assert.Equal(t, float64(5), points[1].Value)
+
+	assert.NoError(t, repo.ResetCounter(context.Background(), "counter1", nil))
+	points, err = repo.History(context.Background(), "counter", "counter1", nil, from, time.Now())
+	assert.NoError(t, err)
+	assert.Len(t, points, 3)
+	assert.Equal(t, float64(0), points[2].Value)
+
+	points, err = repo.History(context.Background(), "gauge", "gauge1", nil, time.Now().Add(time.Minute), time.Now().Add(2*time.Minute))
+	assert.NoError(t, err)
+	assert.Empty(t, points)
+
+	_, err = repo.History(context.Background(), "gauge", "unknown", nil, from, time.Now())
+	assert.ErrorIs(t, err, models.ErrMetricNotFound)
+
+	_, err = memory.NewMemoryRepository().History(context.Background(), "gauge", "gauge1", nil, from, time.Now())
+	assert.ErrorIs(t, err, models.ErrHistoryDisabled)
+}
+
+func TestMemoryRepository_Labels(t *testing.T) {
+	repo := memory.NewMemoryRepository()
+
+	a, b, plain := 1.0, 2.0, 3.0
+	assert.NoError(t, repo.SetMetrics(context.Background(), []models.Metrics{
+		{ID: "Alloc", MType: "gauge", Value: &a, Labels: map[string]string{"host": "a"}},
+		{ID: "Alloc", MType: "gauge", Value: &b, Labels: map[string]string{"host": "b"}},
+		{ID: "Alloc", MType: "gauge", Value: &plain},
+	}))
+
+	metrics, err := repo.List(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, metrics, 3)
+	assert.Nil(t, metrics[0].Labels)
+	assert.Equal(t, map[string]string{"host": "a"}, metrics[1].Labels)
+	assert.Equal(t, 1.0, *metrics[1].Value)
+	assert.Equal(t, map[string]string{"host": "b"}, metrics[2].Labels)
+
+	val, err := repo.GetGauge(context.Background(), "Alloc", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 3.0, val)
+}
+
+func TestMemoryRepository_LabeledLookups(t *testing.T) {
+	repo := memory.NewMemoryRepositoryWithHistory(10)
+	ctx := context.Background()
+	hostA, hostB := map[string]string{"host": "a"}, map[string]string{"host": "b"}
+
+	a, delta := 1.0, int64(5)
+	assert.NoError(t, repo.SetMetrics(ctx, []models.Metrics{
+		{ID: "Alloc", MType: "gauge", Value: &a, Labels: hostA},
+		{ID: "PollCount", MType: "counter", Delta: &delta, Labels: hostA},
+	}))
+
+	val, err := repo.GetGauge(ctx, "Alloc", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 1.0, val)
+	_, err = repo.GetGauge(ctx, "Alloc", hostB)
+	assert.ErrorIs(t, err, models.ErrMetricNotFound)
+
+	points, err := repo.History(ctx, "gauge", "Alloc", nil, time.Time{}, time.Now())
+	assert.NoError(t, err)
+	assert.Len(t, points, 1)
+
+	assert.NoError(t, repo.ResetCounter(ctx, "PollCount", nil))
+	count, err := repo.GetCounter(ctx, "PollCount", hostA)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), count)
+
+	b := 2.0
+	assert.NoError(t, repo.SetMetrics(ctx, []models.Metrics{{ID: "Alloc", MType: "gauge", Value: &b, Labels: hostB}}))
+	_, err = repo.GetGauge(ctx, "Alloc", nil)
+	assert.ErrorIs(t, err, models.ErrAmbiguousMetric)
+	assert.ErrorIs(t, repo.Delete(ctx, "gauge", "Alloc", nil), models.ErrAmbiguousMetric)
+
+	assert.NoError(t, repo.Delete(ctx, "gauge", "Alloc", hostA))
+	val, err = repo.GetGauge(ctx, "Alloc", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 2.0, val)
+}
+
+func TestMemoryRepository_UpdatedAt(t *testing.T) {
+	repo := memory.NewMemoryRepository()
+
+	before := time.Now()
+	assert.NoError(t, repo.SetCounter(context.Background(), "counter1", 1))
+
+	metrics, err := repo.List(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, metrics, 1)
+	assert.False(t, metrics[0].UpdatedAt.Before(before))
+
+	restored := memory.NewMemoryRepository().(*memory.MemoryRepository)
+	assert.NoError(t, restored.Load(metrics[0]))
+	loaded, err := restored.List(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, metrics[0].UpdatedAt, loaded[0].UpdatedAt)
+}
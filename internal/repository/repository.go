@@ -7,6 +7,7 @@ import (
 	"github.com/fireflg/ago-musthave-metrics-tpl/internal/repository/db"
 	"github.com/fireflg/ago-musthave-metrics-tpl/internal/repository/file"
 	"github.com/fireflg/ago-musthave-metrics-tpl/internal/repository/memory"
+	"github.com/fireflg/ago-musthave-metrics-tpl/internal/repository/retry"
 )
 
 type StorageType string
@@ -17,14 +18,39 @@ const (
 	StorageTypeFile     StorageType = "file"
 )
 
+// NewRepository creates the storage selected by cfg. Every storage keeps the last
+// HistorySize values of each series when history is enabled, a zero size disables it.
 func NewRepository(cfg server.Config) (models.MetricsRepository, error) {
+	historySize := 0
+	if cfg.HistoryEnabled {
+		historySize = cfg.HistorySize
+	}
+
 	switch cfg.StorageMode {
 	case string(StorageTypePostgres):
-		return db.NewPostgresRepository(cfg.DatabaseDSN), nil
+		repo, err := db.NewPostgresRepository(cfg.DatabaseDSN, historySize)
+		if err != nil {
+			return nil, err
+		}
+		return retry.NewRepository(repo, db.IsRetriable, db.IsRetriableWrite, retry.DefaultDelays), nil
 	case string(StorageTypeMemory):
+		if historySize > 0 {
+			return memory.NewMemoryRepositoryWithHistory(historySize), nil
+		}
 		return memory.NewMemoryRepository(), nil
 	case string(StorageTypeFile):
-		return file.NewFileRepository(cfg.PersistentStoragePath, cfg.PersistentStorageInterval, cfg.PersistentStorageRestore), nil
+		var repo *file.FileRepository
+		if cfg.PersistentStorageWAL {
+			repo = file.NewFileRepositoryWithWAL(cfg.PersistentStoragePath, cfg.PersistentStorageInterval,
+				cfg.PersistentStorageRestore, cfg.PersistentStorageBackups, cfg.WALCompactRecords)
+		} else {
+			repo = file.NewFileRepository(cfg.PersistentStoragePath, cfg.PersistentStorageInterval,
+				cfg.PersistentStorageRestore, cfg.PersistentStorageBackups)
+		}
+		if historySize > 0 {
+			repo.EnableHistory(historySize)
+		}
+		return repo, nil
 	default:
 		return nil, errors.New("invalid storage mode")
 	}
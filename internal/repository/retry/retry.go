@@ -0,0 +1,133 @@
+package retry
+
+import (
+	"context"
+	"time"
+
+	models "github.com/fireflg/ago-musthave-metrics-tpl/internal/model"
+)
+
+// DefaultDelays are the pauses before the second, third and fourth attempts.
+var DefaultDelays = []time.Duration{1 * time.Second, 3 * time.Second, 5 * time.Second}
+
+// Do calls fn until it succeeds, fails with an error isRetriable rejects, or delays run out.
+func Do(ctx context.Context, delays []time.Duration, isRetriable func(error) bool, fn func() error) error {
+	err := fn()
+	for _, delay := range delays {
+		if err == nil || !isRetriable(err) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		err = fn()
+	}
+	return err
+}
+
+// Repository retries calls to the wrapped repository that fail with retriable errors.
+// Reads are retried on isRetriable, writes only on isRetriableWrite,
+// so that a write which may have been applied is not repeated.
+type Repository struct {
+	models.MetricsRepository
+	isRetriable      func(error) bool
+	isRetriableWrite func(error) bool
+	delays           []time.Duration
+}
+
+func NewRepository(repo models.MetricsRepository, isRetriable, isRetriableWrite func(error) bool, delays []time.Duration) *Repository {
+	return &Repository{
+		MetricsRepository: repo,
+		isRetriable:       isRetriable,
+		isRetriableWrite:  isRetriableWrite,
+		delays:            delays,
+	}
+}
+
+func (r *Repository) do(ctx context.Context, fn func() error) error {
+	return Do(ctx, r.delays, r.isRetriable, fn)
+}
+
+func (r *Repository) write(ctx context.Context, fn func() error) error {
+	return Do(ctx, r.delays, r.isRetriableWrite, fn)
+}
+
+func (r *Repository) GetCounter(ctx context.Context, name string, labels map[string]string) (int64, error) {
+	var value int64
+	err := r.do(ctx, func() (err error) {
+		value, err = r.MetricsRepository.GetCounter(ctx, name, labels)
+		return err
+	})
+	return value, err
+}
+
+func (r *Repository) SetCounter(ctx context.Context, name string, value int64) error {
+	return r.write(ctx, func() error {
+		return r.MetricsRepository.SetCounter(ctx, name, value)
+	})
+}
+
+func (r *Repository) GetGauge(ctx context.Context, name string, labels map[string]string) (float64, error) {
+	var value float64
+	err := r.do(ctx, func() (err error) {
+		value, err = r.MetricsRepository.GetGauge(ctx, name, labels)
+		return err
+	})
+	return value, err
+}
+
+func (r *Repository) SetGauge(ctx context.Context, name string, value float64) error {
+	return r.write(ctx, func() error {
+		return r.MetricsRepository.SetGauge(ctx, name, value)
+	})
+}
+
+func (r *Repository) SetMetric(ctx context.Context, metric models.Metrics) error {
+	return r.write(ctx, func() error {
+		return r.MetricsRepository.SetMetric(ctx, metric)
+	})
+}
+
+func (r *Repository) SetMetrics(ctx context.Context, metrics []models.Metrics) error {
+	return r.write(ctx, func() error {
+		return r.MetricsRepository.SetMetrics(ctx, metrics)
+	})
+}
+
+func (r *Repository) List(ctx context.Context) ([]models.Metrics, error) {
+	var metrics []models.Metrics
+	err := r.do(ctx, func() (err error) {
+		metrics, err = r.MetricsRepository.List(ctx)
+		return err
+	})
+	return metrics, err
+}
+
+func (r *Repository) Delete(ctx context.Context, metricType string, name string, labels map[string]string) error {
+	return r.write(ctx, func() error {
+		return r.MetricsRepository.Delete(ctx, metricType, name, labels)
+	})
+}
+
+func (r *Repository) DeleteMetrics(ctx context.Context, metrics []models.Metrics) error {
+	return r.write(ctx, func() error {
+		return r.MetricsRepository.DeleteMetrics(ctx, metrics)
+	})
+}
+
+func (r *Repository) ResetCounter(ctx context.Context, name string, labels map[string]string) error {
+	return r.write(ctx, func() error {
+		return r.MetricsRepository.ResetCounter(ctx, name, labels)
+	})
+}
+
+func (r *Repository) History(ctx context.Context, metricType string, name string, labels map[string]string, from, to time.Time) ([]models.Point, error) {
+	var points []models.Point
+	err := r.do(ctx, func() (err error) {
+		points, err = r.MetricsRepository.History(ctx, metricType, name, labels, from, to)
+		return err
+	})
+	return points, err
+}
@@ -0,0 +1,114 @@
+package retry_test
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/assert"
+
+	models "github.com/fireflg/ago-musthave-metrics-tpl/internal/model"
+	"github.com/fireflg/ago-musthave-metrics-tpl/internal/repository/db"
+	"github.com/fireflg/ago-musthave-metrics-tpl/internal/repository/retry"
+)
+
+var testDelays = []time.Duration{time.Millisecond, time.Millisecond, time.Millisecond}
+
+const selectGauge = `SELECT labels, delta, value FROM metrics`
+
+func TestRepository_RetriesConnectionException(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer mockDB.Close()
+
+	repo := retry.NewRepository(&db.PostgresRepository{DB: mockDB}, db.IsRetriable, db.IsRetriableWrite, testDelays)
+
+	mock.ExpectQuery(regexp.QuoteMeta(selectGauge)).
+		WithArgs("gauge1", "gauge", "").
+		WillReturnError(&pgconn.PgError{Code: "08006"})
+	mock.ExpectQuery(regexp.QuoteMeta(selectGauge)).
+		WithArgs("gauge1", "gauge", "").
+		WillReturnError(&pgconn.PgError{Code: "40P01"})
+	mock.ExpectQuery(regexp.QuoteMeta(selectGauge)).
+		WithArgs("gauge1", "gauge", "").
+		WillReturnRows(sqlmock.NewRows([]string{"labels", "delta", "value"}).AddRow("", nil, 1.23))
+
+	val, err := repo.GetGauge(context.Background(), "gauge1", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 1.23, val)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRepository_GivesUpAfterDelays(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer mockDB.Close()
+
+	repo := retry.NewRepository(&db.PostgresRepository{DB: mockDB}, db.IsRetriable, db.IsRetriableWrite, testDelays)
+
+	for i := 0; i < len(testDelays)+1; i++ {
+		mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO metrics`)).
+			WillReturnError(&pgconn.PgError{Code: "40001"})
+	}
+
+	value := 1.23
+	err = repo.SetMetric(context.Background(), models.Metrics{ID: "gauge1", MType: "gauge", Value: &value})
+	assert.Error(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRepository_NonRetriableSurfacesImmediately(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer mockDB.Close()
+
+	repo := retry.NewRepository(&db.PostgresRepository{DB: mockDB}, db.IsRetriable, db.IsRetriableWrite, testDelays)
+
+	mock.ExpectQuery(regexp.QuoteMeta(selectGauge)).
+		WithArgs("missing", "gauge", "").
+		WillReturnRows(sqlmock.NewRows([]string{"labels", "delta", "value"}))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO metrics`)).
+		WillReturnError(&pgconn.PgError{Code: "23502"})
+
+	_, err = repo.GetGauge(context.Background(), "missing", nil)
+	assert.ErrorIs(t, err, models.ErrMetricNotFound)
+
+	value := 1.23
+	err = repo.SetMetric(context.Background(), models.Metrics{ID: "gauge1", MType: "gauge", Value: &value})
+	assert.Error(t, err)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRepository_DoesNotRetryWriteOnLostConnection(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer mockDB.Close()
+
+	repo := retry.NewRepository(&db.PostgresRepository{DB: mockDB}, db.IsRetriable, db.IsRetriableWrite, testDelays)
+
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO metrics`)).
+		WillReturnError(&pgconn.PgError{Code: "08006"})
+
+	delta := int64(5)
+	err = repo.SetMetric(context.Background(), models.Metrics{ID: "counter1", MType: "counter", Delta: &delta})
+	assert.Error(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestDo_StopsOnContextCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	calls := 0
+	err := retry.Do(ctx, []time.Duration{time.Hour}, func(error) bool { return true }, func() error {
+		calls++
+		return errors.New("temporary")
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 1, calls)
+}
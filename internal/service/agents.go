@@ -0,0 +1,42 @@
+package service
+
+import (
+	"sort"
+	"sync"
+
+	models "github.com/fireflg/ago-musthave-metrics-tpl/internal/model"
+)
+
+// AgentRegistry tracks the agents that reported metrics.
+type AgentRegistry struct {
+	mu     sync.Mutex
+	agents map[string]models.AgentInfo
+}
+
+func NewAgentRegistry() *AgentRegistry {
+	return &AgentRegistry{agents: make(map[string]models.AgentInfo)}
+}
+
+// Seen records an update from an agent, updates without an agent ID are ignored.
+func (r *AgentRegistry) Seen(agent models.AgentInfo) {
+	if agent.ID == "" {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.agents[agent.ID] = agent
+}
+
+// List returns the known agents sorted by ID.
+func (r *AgentRegistry) List() []models.AgentInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	result := make([]models.AgentInfo, 0, len(r.agents))
+	for _, agent := range r.agents {
+		result = append(result, agent)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ID < result[j].ID })
+	return result
+}
@@ -0,0 +1,26 @@
+package service
+
+import (
+	"context"
+
+	models "github.com/fireflg/ago-musthave-metrics-tpl/internal/model"
+)
+
+// AuditObserver receives an event for every accepted metric update.
+// Notify is called synchronously, slow observers should queue events themselves.
+type AuditObserver interface {
+	Notify(event models.AuditEvent)
+}
+
+type remoteIPKey struct{}
+
+// WithRemoteIP returns a context carrying the address of the client that sent an update.
+func WithRemoteIP(ctx context.Context, ip string) context.Context {
+	return context.WithValue(ctx, remoteIPKey{}, ip)
+}
+
+// RemoteIP returns the client address stored by WithRemoteIP.
+func RemoteIP(ctx context.Context) string {
+	ip, _ := ctx.Value(remoteIPKey{}).(string)
+	return ip
+}
@@ -6,66 +6,118 @@ import (
 	"github.com/fireflg/ago-musthave-metrics-tpl/internal/config/server"
 	models "github.com/fireflg/ago-musthave-metrics-tpl/internal/model"
 	_ "github.com/jackc/pgx/v5/stdlib"
+	"strings"
+	"sync"
 	"time"
 )
 
 type MetricsService interface {
-	SetMetric(metric models.Metrics) error
-	SetMetricBatch(metrics []models.Metrics) error
+	SetMetric(ctx context.Context, metric models.Metrics) error
+	SetMetricBatch(ctx context.Context, metrics []models.Metrics) error
 	GetMetric(metricType string, metricName string) (models.Metrics, error)
+	GetLabeledMetric(metricType string, metricName string, labels map[string]string) (models.Metrics, error)
+	ListMetrics(metricType string, prefix string, labels map[string]string) ([]models.Metrics, error)
+	DeleteMetric(metricType string, metricName string, labels map[string]string) error
+	DeleteMetricBatch(metrics []models.Metrics) error
+	ResetCounter(metricName string, labels map[string]string) error
+	GetHistory(metricType string, metricName string, labels map[string]string, from, to time.Time, step time.Duration) ([]models.Point, error)
 	CheckRepository() error
+	RecordAgent(agent models.AgentInfo)
+	ListAgents() []models.AgentInfo
+	Attach(observer AuditObserver)
 }
 type MetricsServiceImpl struct {
-	repo models.MetricsRepository
-	Cfg  *server.Config
+	repo   models.MetricsRepository
+	agents *AgentRegistry
+	Cfg    *server.Config
+
+	mu        sync.RWMutex
+	observers []AuditObserver
 }
 
 var _ MetricsService = (*MetricsServiceImpl)(nil)
 
 func NewMetricsService(repo models.MetricsRepository) MetricsService {
-	return &MetricsServiceImpl{repo: repo}
+	return &MetricsServiceImpl{repo: repo, agents: NewAgentRegistry()}
 }
 
-func (m *MetricsServiceImpl) SetMetric(metric models.Metrics) error {
-	ctx := context.Background()
+func (m *MetricsServiceImpl) SetMetric(ctx context.Context, metric models.Metrics) error {
 	if err := m.repo.SetMetric(ctx, metric); err != nil {
 		return err
 	}
+	m.audit(ctx, []models.Metrics{metric})
 	return nil
 }
 
-func (m *MetricsServiceImpl) SetMetricBatch(metrics []models.Metrics) error {
+func (m *MetricsServiceImpl) SetMetricBatch(ctx context.Context, metrics []models.Metrics) error {
+	if err := m.repo.SetMetrics(ctx, metrics); err != nil {
+		return err
+	}
+	m.audit(ctx, metrics)
+	return nil
+}
+
+// Attach subscribes observer to audit events of accepted updates.
+func (m *MetricsServiceImpl) Attach(observer AuditObserver) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.observers = append(m.observers, observer)
+}
+
+// audit notifies the observers about accepted metrics, the client address is taken from ctx.
+func (m *MetricsServiceImpl) audit(ctx context.Context, metrics []models.Metrics) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if len(m.observers) == 0 || len(metrics) == 0 {
+		return
+	}
+
+	names := make([]string, 0, len(metrics))
+	seen := make(map[string]bool, len(metrics))
 	for _, metric := range metrics {
-		ctx := context.Background()
-		if err := m.repo.SetMetric(ctx, metric); err != nil {
-			return err
+		if !seen[metric.ID] {
+			seen[metric.ID] = true
+			names = append(names, metric.ID)
 		}
 	}
-	return nil
+
+	event := models.AuditEvent{TS: time.Now().Unix(), Metrics: names, IPAddress: RemoteIP(ctx)}
+	for _, observer := range m.observers {
+		observer.Notify(event)
+	}
 }
 
+// GetMetric returns the metric with the given name, see GetLabeledMetric.
 func (m *MetricsServiceImpl) GetMetric(metricType string, metricName string) (models.Metrics, error) {
+	return m.GetLabeledMetric(metricType, metricName, nil)
+}
+
+// GetLabeledMetric returns the metric stored under the given label set. Without labels
+// the unlabeled series is returned, or the only series of that name.
+func (m *MetricsServiceImpl) GetLabeledMetric(metricType string, metricName string, labels map[string]string) (models.Metrics, error) {
 	switch metricType {
 	case "counter":
-		delta, err := m.repo.GetCounter(context.Background(), metricName)
+		delta, err := m.repo.GetCounter(context.Background(), metricName, labels)
 		if err != nil {
 			return models.Metrics{}, err
 		}
 		return models.Metrics{
-			ID:    metricName,
-			MType: "counter",
-			Delta: &delta,
+			ID:     metricName,
+			MType:  "counter",
+			Delta:  &delta,
+			Labels: labels,
 		}, nil
 
 	case "gauge":
-		value, err := m.repo.GetGauge(context.Background(), metricName)
+		value, err := m.repo.GetGauge(context.Background(), metricName, labels)
 		if err != nil {
 			return models.Metrics{}, err
 		}
 		return models.Metrics{
-			ID:    metricName,
-			MType: "gauge",
-			Value: &value,
+			ID:     metricName,
+			MType:  "gauge",
+			Value:  &value,
+			Labels: labels,
 		}, nil
 
 	default:
@@ -73,6 +125,87 @@ func (m *MetricsServiceImpl) GetMetric(metricType string, metricName string) (mo
 	}
 }
 
+// ListMetrics returns stored metrics of the given type whose ID starts with prefix and
+// that carry every label in labels. Empty arguments match every metric.
+func (m *MetricsServiceImpl) ListMetrics(metricType string, prefix string, labels map[string]string) ([]models.Metrics, error) {
+	if metricType != "" && metricType != models.Gauge && metricType != models.Counter {
+		return nil, fmt.Errorf("unknown metric type: %s", metricType)
+	}
+
+	metrics, err := m.repo.List(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]models.Metrics, 0, len(metrics))
+	for _, metric := range metrics {
+		if metricType != "" && metric.MType != metricType {
+			continue
+		}
+		if !strings.HasPrefix(metric.ID, prefix) || !metric.HasLabels(labels) {
+			continue
+		}
+		result = append(result, metric)
+	}
+	return result, nil
+}
+
+func (m *MetricsServiceImpl) DeleteMetric(metricType string, metricName string, labels map[string]string) error {
+	if metricType != models.Gauge && metricType != models.Counter {
+		return fmt.Errorf("unknown metric type: %s", metricType)
+	}
+	return m.repo.Delete(context.Background(), metricType, metricName, labels)
+}
+
+// DeleteMetricBatch removes every listed metric or, on error, none of them.
+// Metrics that are already absent are skipped.
+func (m *MetricsServiceImpl) DeleteMetricBatch(metrics []models.Metrics) error {
+	for _, metric := range metrics {
+		if metric.MType != models.Gauge && metric.MType != models.Counter {
+			return fmt.Errorf("unknown metric type: %s", metric.MType)
+		}
+	}
+	return m.repo.DeleteMetrics(context.Background(), metrics)
+}
+
+func (m *MetricsServiceImpl) ResetCounter(metricName string, labels map[string]string) error {
+	return m.repo.ResetCounter(context.Background(), metricName, labels)
+}
+
+// GetHistory returns recorded values of a metric between from and to.
+// A positive step averages the points within each step-aligned interval.
+func (m *MetricsServiceImpl) GetHistory(metricType string, metricName string, labels map[string]string, from, to time.Time, step time.Duration) ([]models.Point, error) {
+	if metricType != models.Gauge && metricType != models.Counter {
+		return nil, fmt.Errorf("unknown metric type: %s", metricType)
+	}
+
+	points, err := m.repo.History(context.Background(), metricType, metricName, labels, from, to)
+	if err != nil {
+		return nil, err
+	}
+	if step <= 0 {
+		return points, nil
+	}
+	return downsample(points, step), nil
+}
+
+func downsample(points []models.Point, step time.Duration) []models.Point {
+	result := make([]models.Point, 0)
+	var sum float64
+	var count int
+	for i, point := range points {
+		bucket := point.Timestamp.Truncate(step)
+		sum += point.Value
+		count++
+
+		if i == len(points)-1 || !points[i+1].Timestamp.Truncate(step).Equal(bucket) {
+			result = append(result, models.Point{Timestamp: bucket, Value: sum / float64(count)})
+			sum, count = 0, 0
+		}
+	}
+	return result
+}
+
 func (m *MetricsServiceImpl) CheckRepository() error {
 	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
 	defer cancel()
@@ -81,3 +214,13 @@ func (m *MetricsServiceImpl) CheckRepository() error {
 	}
 	return nil
 }
+
+// RecordAgent remembers the agent that sent the latest update.
+func (m *MetricsServiceImpl) RecordAgent(agent models.AgentInfo) {
+	m.agents.Seen(agent)
+}
+
+// ListAgents returns the agents that sent updates, sorted by ID.
+func (m *MetricsServiceImpl) ListAgents() []models.AgentInfo {
+	return m.agents.List()
+}
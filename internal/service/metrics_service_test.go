@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"testing"
+	"time"
 
 	models "github.com/fireflg/ago-musthave-metrics-tpl/internal/model"
 	"github.com/fireflg/ago-musthave-metrics-tpl/internal/service"
@@ -20,6 +21,11 @@ func (m *MockMetricsRepo) SetMetric(ctx context.Context, metric models.Metrics)
 	return args.Error(0)
 }
 
+func (m *MockMetricsRepo) SetMetrics(ctx context.Context, metrics []models.Metrics) error {
+	args := m.Called(ctx, metrics)
+	return args.Error(0)
+}
+
 func (m *MockMetricsRepo) SetCounter(ctx context.Context, id string, delta int64) error {
 	args := m.Called(ctx, id, delta)
 	return args.Error(0)
@@ -30,16 +36,46 @@ func (m *MockMetricsRepo) SetGauge(ctx context.Context, id string, value float64
 	return args.Error(0)
 }
 
-func (m *MockMetricsRepo) GetCounter(ctx context.Context, id string) (int64, error) {
-	args := m.Called(ctx, id)
+func (m *MockMetricsRepo) GetCounter(ctx context.Context, id string, labels map[string]string) (int64, error) {
+	args := m.Called(ctx, id, labels)
 	return args.Get(0).(int64), args.Error(1)
 }
 
-func (m *MockMetricsRepo) GetGauge(ctx context.Context, id string) (float64, error) {
-	args := m.Called(ctx, id)
+func (m *MockMetricsRepo) GetGauge(ctx context.Context, id string, labels map[string]string) (float64, error) {
+	args := m.Called(ctx, id, labels)
 	return args.Get(0).(float64), args.Error(1)
 }
 
+func (m *MockMetricsRepo) List(ctx context.Context) ([]models.Metrics, error) {
+	args := m.Called(ctx)
+	return args.Get(0).([]models.Metrics), args.Error(1)
+}
+
+func (m *MockMetricsRepo) Delete(ctx context.Context, metricType string, id string, labels map[string]string) error {
+	args := m.Called(ctx, metricType, id, labels)
+	return args.Error(0)
+}
+
+func (m *MockMetricsRepo) DeleteMetrics(ctx context.Context, metrics []models.Metrics) error {
+	args := m.Called(ctx, metrics)
+	return args.Error(0)
+}
+
+func (m *MockMetricsRepo) ResetCounter(ctx context.Context, id string, labels map[string]string) error {
+	args := m.Called(ctx, id, labels)
+	return args.Error(0)
+}
+
+func (m *MockMetricsRepo) History(ctx context.Context, metricType string, id string, labels map[string]string, from, to time.Time) ([]models.Point, error) {
+	args := m.Called(ctx, metricType, id, labels, from, to)
+	return args.Get(0).([]models.Point), args.Error(1)
+}
+
+func (m *MockMetricsRepo) Close(ctx context.Context) error {
+	args := m.Called(ctx)
+	return args.Error(0)
+}
+
 func (m *MockMetricsRepo) Ping(ctx context.Context) error {
 	args := m.Called(ctx)
 	return args.Error(0)
@@ -62,7 +98,7 @@ func TestSetMetric(t *testing.T) {
 		}),
 	).Return(nil)
 
-	err := svc.SetMetric(models.Metrics{
+	err := svc.SetMetric(context.Background(), models.Metrics{
 		ID:    "counter1",
 		MType: "counter",
 		Delta: &delta,
@@ -82,7 +118,7 @@ func TestSetMetric(t *testing.T) {
 		}),
 	).Return(nil)
 
-	err = svc.SetMetric(models.Metrics{
+	err = svc.SetMetric(context.Background(), models.Metrics{
 		ID:    "gauge1",
 		MType: "gauge",
 		Value: &value,
@@ -97,7 +133,7 @@ func TestSetMetric(t *testing.T) {
 		}),
 	).Return(errors.New("unknown metric type"))
 
-	err = svc.SetMetric(models.Metrics{
+	err = svc.SetMetric(context.Background(), models.Metrics{
 		ID:    "unknown",
 		MType: "unknown",
 	})
@@ -116,10 +152,10 @@ func TestSetMetricBatch(t *testing.T) {
 	value := 3.14
 
 	repo.On(
-		"SetMetric",
+		"SetMetrics",
 		mock.Anything,
-		mock.AnythingOfType("models.Metrics"),
-	).Return(nil).Twice()
+		mock.AnythingOfType("[]models.Metrics"),
+	).Return(nil).Once()
 
 	metrics := []models.Metrics{
 		{
@@ -134,20 +170,59 @@ func TestSetMetricBatch(t *testing.T) {
 		},
 	}
 
-	err := svc.SetMetricBatch(metrics)
+	err := svc.SetMetricBatch(context.Background(), metrics)
 	assert.NoError(t, err)
 
-	repo.AssertNumberOfCalls(t, "SetMetric", 2)
+	repo.AssertNumberOfCalls(t, "SetMetrics", 1)
+	repo.AssertNotCalled(t, "SetMetric", mock.Anything, mock.Anything)
+}
+
+type auditRecorder struct {
+	events []models.AuditEvent
+}
+
+func (r *auditRecorder) Notify(event models.AuditEvent) {
+	r.events = append(r.events, event)
+}
+
+func TestAuditObservers(t *testing.T) {
+	repo := new(MockMetricsRepo)
+	svc := service.NewMetricsService(repo)
+	recorder := &auditRecorder{}
+	svc.Attach(recorder)
+
+	delta := int64(1)
+	value := 2.5
+	repo.On("SetMetrics", mock.Anything, mock.Anything).Return(nil).Once()
+	repo.On("SetMetrics", mock.Anything, mock.Anything).Return(errors.New("db down")).Once()
+
+	ctx := service.WithRemoteIP(context.Background(), "10.0.0.7")
+	err := svc.SetMetricBatch(ctx, []models.Metrics{
+		{ID: "PollCount", MType: models.Counter, Delta: &delta},
+		{ID: "Alloc", MType: models.Gauge, Value: &value},
+		{ID: "PollCount", MType: models.Counter, Delta: &delta},
+	})
+	assert.NoError(t, err)
+
+	err = svc.SetMetricBatch(ctx, []models.Metrics{{ID: "Alloc", MType: models.Gauge, Value: &value}})
+	assert.Error(t, err)
+
+	if assert.Len(t, recorder.events, 1) {
+		event := recorder.events[0]
+		assert.Equal(t, []string{"PollCount", "Alloc"}, event.Metrics)
+		assert.Equal(t, "10.0.0.7", event.IPAddress)
+		assert.NotZero(t, event.TS)
+	}
 }
 
 func TestGetMetric(t *testing.T) {
 	repo := new(MockMetricsRepo)
 	svc := service.NewMetricsService(repo)
 
-	repo.On("GetCounter", mock.Anything, "counter1").
+	repo.On("GetCounter", mock.Anything, "counter1", mock.Anything).
 		Return(int64(42), nil)
 
-	repo.On("GetGauge", mock.Anything, "gauge1").
+	repo.On("GetGauge", mock.Anything, "gauge1", mock.Anything).
 		Return(3.14, nil)
 
 	m, err := svc.GetMetric("counter", "counter1")
@@ -165,3 +240,111 @@ func TestGetMetric(t *testing.T) {
 
 	repo.AssertExpectations(t)
 }
+
+func TestListMetrics(t *testing.T) {
+	repo := new(MockMetricsRepo)
+	svc := service.NewMetricsService(repo)
+
+	delta := int64(7)
+	heap := 1.5
+	alloc := 2.5
+	repo.On("List", mock.Anything).Return([]models.Metrics{
+		{ID: "Alloc", MType: "gauge", Value: &alloc},
+		{ID: "HeapAlloc", MType: "gauge", Value: &heap},
+		{ID: "HeapCount", MType: "counter", Delta: &delta},
+	}, nil)
+
+	all, err := svc.ListMetrics("", "", nil)
+	assert.NoError(t, err)
+	assert.Len(t, all, 3)
+
+	gauges, err := svc.ListMetrics("gauge", "Heap", nil)
+	assert.NoError(t, err)
+	assert.Len(t, gauges, 1)
+	assert.Equal(t, "HeapAlloc", gauges[0].ID)
+
+	counters, err := svc.ListMetrics("counter", "", nil)
+	assert.NoError(t, err)
+	assert.Len(t, counters, 1)
+	assert.Equal(t, "HeapCount", counters[0].ID)
+
+	_, err = svc.ListMetrics("unknown", "", nil)
+	assert.Error(t, err)
+}
+
+func TestListMetrics_Labels(t *testing.T) {
+	repo := new(MockMetricsRepo)
+	svc := service.NewMetricsService(repo)
+
+	a, b := 1.5, 2.5
+	repo.On("List", mock.Anything).Return([]models.Metrics{
+		{ID: "Alloc", MType: "gauge", Value: &a, Labels: map[string]string{"host": "a", "env": "prod"}},
+		{ID: "Alloc", MType: "gauge", Value: &b, Labels: map[string]string{"host": "b"}},
+	}, nil)
+
+	hostA, err := svc.ListMetrics("", "", map[string]string{"host": "a"})
+	assert.NoError(t, err)
+	assert.Len(t, hostA, 1)
+	assert.Equal(t, 1.5, *hostA[0].Value)
+
+	repo.On("GetGauge", mock.Anything, "Alloc", map[string]string{"host": "b"}).Return(2.5, nil)
+	repo.On("GetGauge", mock.Anything, "Alloc", map[string]string{"host": "c"}).Return(0.0, models.ErrMetricNotFound)
+
+	metric, err := svc.GetLabeledMetric("gauge", "Alloc", map[string]string{"host": "b"})
+	assert.NoError(t, err)
+	assert.Equal(t, 2.5, *metric.Value)
+	assert.Equal(t, map[string]string{"host": "b"}, metric.Labels)
+
+	_, err = svc.GetLabeledMetric("gauge", "Alloc", map[string]string{"host": "c"})
+	assert.ErrorIs(t, err, models.ErrMetricNotFound)
+}
+
+func TestDeleteMetricBatch(t *testing.T) {
+	repo := new(MockMetricsRepo)
+	svc := service.NewMetricsService(repo)
+
+	batch := []models.Metrics{
+		{ID: "Alloc", MType: "gauge"},
+		{ID: "OldCount", MType: "counter"},
+	}
+	repo.On("DeleteMetrics", mock.Anything, batch).Return(nil)
+
+	err := svc.DeleteMetricBatch(batch)
+	assert.NoError(t, err)
+
+	err = svc.DeleteMetricBatch([]models.Metrics{{ID: "x", MType: "unknown"}})
+	assert.Error(t, err)
+
+	repo.AssertExpectations(t)
+}
+
+func TestGetHistory(t *testing.T) {
+	repo := new(MockMetricsRepo)
+	svc := service.NewMetricsService(repo)
+
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	from, to := start, start.Add(time.Hour)
+	points := []models.Point{
+		{Timestamp: start.Add(10 * time.Second), Value: 1},
+		{Timestamp: start.Add(20 * time.Second), Value: 3},
+		{Timestamp: start.Add(70 * time.Second), Value: 10},
+		{Timestamp: start.Add(200 * time.Second), Value: 4},
+		{Timestamp: start.Add(230 * time.Second), Value: 8},
+	}
+	repo.On("History", mock.Anything, "gauge", "Alloc", mock.Anything, from, to).Return(points, nil)
+
+	raw, err := svc.GetHistory("gauge", "Alloc", nil, from, to, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, points, raw)
+
+	downsampled, err := svc.GetHistory("gauge", "Alloc", nil, from, to, time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, []models.Point{
+		{Timestamp: start, Value: 2},
+		{Timestamp: start.Add(time.Minute), Value: 10},
+		{Timestamp: start.Add(3 * time.Minute), Value: 6},
+	}, downsampled)
+
+	_, err = svc.GetHistory("unknown", "Alloc", nil, from, to, 0)
+	assert.Error(t, err)
+}
@@ -0,0 +1,133 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	models "github.com/fireflg/ago-musthave-metrics-tpl/internal/model"
+	"github.com/fireflg/ago-musthave-metrics-tpl/internal/webhook"
+	"go.uber.org/zap"
+)
+
+// StaleChecker periodically looks for metrics and agents that were not updated within ttl.
+// Newly stale entries are logged and, when webhookURL is set, posted to it as a StaleReport.
+type StaleChecker struct {
+	service MetricsService
+	ttl     time.Duration
+	webhook *webhook.Client
+	logger  *zap.SugaredLogger
+
+	mu     sync.Mutex
+	report models.StaleReport
+	// notified is the report the webhook last accepted, entries stale since then are posted on the next check.
+	notified models.StaleReport
+}
+
+func NewStaleChecker(service MetricsService, ttl time.Duration, webhookURL string, logger *zap.SugaredLogger) *StaleChecker {
+	c := &StaleChecker{
+		service: service,
+		ttl:     ttl,
+		logger:  logger,
+		report:  models.StaleReport{Metrics: []models.Metrics{}, Agents: []models.AgentInfo{}},
+	}
+	c.notified = c.report
+	if webhookURL != "" {
+		c.webhook = webhook.NewClient(webhookURL)
+	}
+	return c
+}
+
+// Run checks for stale entries every interval until ctx is cancelled.
+func (c *StaleChecker) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.Check(ctx, time.Now()); err != nil {
+				c.logger.Errorw("Stale check failed", "error", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Check rebuilds the stale report as of now.
+func (c *StaleChecker) Check(ctx context.Context, now time.Time) error {
+	metrics, err := c.service.ListMetrics("", "", nil)
+	if err != nil {
+		return fmt.Errorf("list metrics: %w", err)
+	}
+
+	report := models.StaleReport{CheckedAt: now, Metrics: []models.Metrics{}, Agents: []models.AgentInfo{}}
+	for _, metric := range metrics {
+		if !metric.UpdatedAt.IsZero() && now.Sub(metric.UpdatedAt) > c.ttl {
+			report.Metrics = append(report.Metrics, metric)
+		}
+	}
+	for _, agent := range c.service.ListAgents() {
+		if now.Sub(agent.LastSeen) > c.ttl {
+			report.Agents = append(report.Agents, agent)
+		}
+	}
+
+	c.mu.Lock()
+	logged := newlyStale(c.report, report)
+	unsent := newlyStale(c.notified, report)
+	c.report = report
+	c.mu.Unlock()
+
+	for _, metric := range logged.Metrics {
+		c.logger.Warnw("Metric is stale", "id", metric.ID, "type", metric.MType, "labels", metric.Labels, "updated_at", metric.UpdatedAt)
+	}
+	for _, agent := range logged.Agents {
+		c.logger.Warnw("Agent is stale", "id", agent.ID, "remote_addr", agent.RemoteAddr, "last_seen", agent.LastSeen)
+	}
+
+	if c.webhook != nil && (len(unsent.Metrics) > 0 || len(unsent.Agents) > 0) {
+		if err := c.webhook.Post(ctx, unsent); err != nil {
+			return err
+		}
+	}
+
+	c.mu.Lock()
+	c.notified = report
+	c.mu.Unlock()
+	return nil
+}
+
+// Report returns the result of the latest check.
+func (c *StaleChecker) Report() models.StaleReport {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.report
+}
+
+// newlyStale returns the entries of current that were not stale in previous.
+func newlyStale(previous, current models.StaleReport) models.StaleReport {
+	seenMetrics := make(map[string]bool, len(previous.Metrics))
+	for _, metric := range previous.Metrics {
+		seenMetrics[metric.MType+"/"+metric.Key()] = true
+	}
+	seenAgents := make(map[string]bool, len(previous.Agents))
+	for _, agent := range previous.Agents {
+		seenAgents[agent.ID] = true
+	}
+
+	result := models.StaleReport{CheckedAt: current.CheckedAt, Metrics: []models.Metrics{}, Agents: []models.AgentInfo{}}
+	for _, metric := range current.Metrics {
+		if !seenMetrics[metric.MType+"/"+metric.Key()] {
+			result.Metrics = append(result.Metrics, metric)
+		}
+	}
+	for _, agent := range current.Agents {
+		if !seenAgents[agent.ID] {
+			result.Agents = append(result.Agents, agent)
+		}
+	}
+	return result
+}
@@ -0,0 +1,101 @@
+package service_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	models "github.com/fireflg/ago-musthave-metrics-tpl/internal/model"
+	"github.com/fireflg/ago-musthave-metrics-tpl/internal/repository/memory"
+	"github.com/fireflg/ago-musthave-metrics-tpl/internal/service"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestStaleChecker(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		reports []models.StaleReport
+	)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var report models.StaleReport
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&report))
+		mu.Lock()
+		reports = append(reports, report)
+		mu.Unlock()
+	}))
+	defer webhook.Close()
+
+	svc := service.NewMetricsService(memory.NewMemoryRepository())
+	value := 1.5
+	require.NoError(t, svc.SetMetric(context.Background(), models.Metrics{ID: "Alloc", MType: "gauge", Value: &value}))
+	svc.RecordAgent(models.AgentInfo{ID: "agent-1", LastSeen: time.Now()})
+
+	checker := service.NewStaleChecker(svc, time.Minute, webhook.URL, zap.NewNop().Sugar())
+
+	require.NoError(t, checker.Check(context.Background(), time.Now()))
+	assert.Empty(t, checker.Report().Metrics)
+	assert.Empty(t, checker.Report().Agents)
+
+	later := time.Now().Add(2 * time.Minute)
+	require.NoError(t, checker.Check(context.Background(), later))
+	report := checker.Report()
+	require.Len(t, report.Metrics, 1)
+	assert.Equal(t, "Alloc", report.Metrics[0].ID)
+	require.Len(t, report.Agents, 1)
+	assert.Equal(t, "agent-1", report.Agents[0].ID)
+
+	// Entries that are still stale are not reported to the webhook again.
+	require.NoError(t, checker.Check(context.Background(), later.Add(time.Minute)))
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, reports, 1)
+	assert.Len(t, reports[0].Metrics, 1)
+	assert.Len(t, reports[0].Agents, 1)
+}
+
+func TestStaleChecker_ResendsAfterWebhookFailure(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		failures = 1
+		reports  []models.StaleReport
+	)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if failures > 0 {
+			failures--
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		var report models.StaleReport
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&report))
+		reports = append(reports, report)
+	}))
+	defer webhook.Close()
+
+	svc := service.NewMetricsService(memory.NewMemoryRepository())
+	value := 1.5
+	require.NoError(t, svc.SetMetric(context.Background(), models.Metrics{ID: "Alloc", MType: "gauge", Value: &value}))
+
+	checker := service.NewStaleChecker(svc, time.Minute, webhook.URL, zap.NewNop().Sugar())
+
+	later := time.Now().Add(2 * time.Minute)
+	assert.Error(t, checker.Check(context.Background(), later))
+	assert.Len(t, checker.Report().Metrics, 1)
+
+	require.NoError(t, checker.Check(context.Background(), later.Add(time.Minute)))
+	require.NoError(t, checker.Check(context.Background(), later.Add(2*time.Minute)))
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, reports, 1)
+	require.Len(t, reports[0].Metrics, 1)
+	assert.Equal(t, "Alloc", reports[0].Metrics[0].ID)
+}
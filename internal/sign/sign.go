@@ -0,0 +1,26 @@
+package sign
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// HeaderName is the HTTP header carrying the hex encoded HMAC-SHA256 of the body.
+const HeaderName = "HashSHA256"
+
+func Sign(data []byte, key string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func Verify(data []byte, key string, signature string) bool {
+	expected, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(data)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
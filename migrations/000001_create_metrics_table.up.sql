@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS metrics (
+    id    VARCHAR(255) PRIMARY KEY,
+    type  VARCHAR(255) NOT NULL,
+    delta INTEGER,
+    value DOUBLE PRECISION,
+    hash  VARCHAR(64)
+);
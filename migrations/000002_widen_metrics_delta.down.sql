@@ -0,0 +1 @@
+ALTER TABLE metrics ALTER COLUMN delta TYPE INTEGER;
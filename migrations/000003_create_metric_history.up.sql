@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS metric_history (
+    id         VARCHAR(255) NOT NULL,
+    type       VARCHAR(255) NOT NULL,
+    value      DOUBLE PRECISION NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS metric_history_id_type_created_at_idx
+    ON metric_history (id, type, created_at);
@@ -0,0 +1,10 @@
+DROP INDEX IF EXISTS metric_history_id_type_labels_created_at_idx;
+DELETE FROM metric_history WHERE labels <> '';
+ALTER TABLE metric_history DROP COLUMN IF EXISTS labels;
+CREATE INDEX IF NOT EXISTS metric_history_id_type_created_at_idx
+    ON metric_history (id, type, created_at);
+
+DELETE FROM metrics WHERE labels <> '';
+ALTER TABLE metrics DROP CONSTRAINT IF EXISTS metrics_pkey;
+ALTER TABLE metrics ADD PRIMARY KEY (id);
+ALTER TABLE metrics DROP COLUMN IF EXISTS labels;
@@ -0,0 +1,8 @@
+ALTER TABLE metrics ADD COLUMN IF NOT EXISTS labels TEXT NOT NULL DEFAULT '';
+ALTER TABLE metrics DROP CONSTRAINT IF EXISTS metrics_pkey;
+ALTER TABLE metrics ADD PRIMARY KEY (id, labels);
+
+ALTER TABLE metric_history ADD COLUMN IF NOT EXISTS labels TEXT NOT NULL DEFAULT '';
+DROP INDEX IF EXISTS metric_history_id_type_created_at_idx;
+CREATE INDEX IF NOT EXISTS metric_history_id_type_labels_created_at_idx
+    ON metric_history (id, type, labels, created_at);
@@ -0,0 +1,8 @@
+package migrations
+
+import "embed"
+
+// FS holds the SQL migrations applied by golang-migrate, named <version>_<title>.<up|down>.sql.
+//
+//go:embed *.sql
+var FS embed.FS
@@ -0,0 +1,93 @@
+package migrations_test
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"strings"
+	"testing"
+
+	"github.com/fireflg/ago-musthave-metrics-tpl/migrations"
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/golang-migrate/migrate/v4/database"
+	"github.com/golang-migrate/migrate/v4/database/stub"
+	"github.com/golang-migrate/migrate/v4/source/iofs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrationsHaveDown(t *testing.T) {
+	ups, err := fs.Glob(migrations.FS, "*.up.sql")
+	require.NoError(t, err)
+	require.NotEmpty(t, ups)
+
+	for _, up := range ups {
+		down := strings.TrimSuffix(up, ".up.sql") + ".down.sql"
+		_, err := fs.Stat(migrations.FS, down)
+		assert.NoError(t, err, "missing %s", down)
+	}
+}
+
+// readMigration returns the body of a migration file, failing the test when it is missing or empty.
+func readMigration(t *testing.T, r io.ReadCloser, identifier string, err error) string {
+	t.Helper()
+	require.NoError(t, err, identifier)
+	defer r.Close()
+
+	body, err := io.ReadAll(r)
+	require.NoError(t, err, identifier)
+	require.NotEmpty(t, strings.TrimSpace(string(body)), "empty migration %s", identifier)
+	return string(body)
+}
+
+// TestMigrationsParse walks every embedded version and checks that it has both an up and a down
+// migration, then applies the whole sequence up and back down in order.
+func TestMigrationsParse(t *testing.T) {
+	source, err := iofs.New(migrations.FS, ".")
+	require.NoError(t, err)
+	defer source.Close()
+
+	var versions []uint
+	var ups, downs []string
+	version, err := source.First()
+	for err == nil {
+		versions = append(versions, version)
+
+		r, identifier, readErr := source.ReadUp(version)
+		ups = append(ups, readMigration(t, r, identifier, readErr))
+		r, identifier, readErr = source.ReadDown(version)
+		downs = append(downs, readMigration(t, r, identifier, readErr))
+
+		version, err = source.Next(version)
+	}
+	require.True(t, errors.Is(err, fs.ErrNotExist), "walk versions: %v", err)
+	require.NotEmpty(t, versions)
+	for i, version := range versions {
+		assert.Equal(t, uint(i+1), version, "versions must be consecutive")
+	}
+
+	upSource, err := iofs.New(migrations.FS, ".")
+	require.NoError(t, err)
+	driver, err := stub.WithInstance(nil, &stub.Config{})
+	require.NoError(t, err)
+	m, err := migrate.NewWithInstance("iofs", upSource, "stub", driver)
+	require.NoError(t, err)
+	defer m.Close()
+
+	require.NoError(t, m.Up())
+	applied, dirty, err := m.Version()
+	require.NoError(t, err)
+	assert.False(t, dirty)
+	assert.Equal(t, versions[len(versions)-1], applied)
+
+	require.NoError(t, m.Down())
+	_, _, err = m.Version()
+	assert.ErrorIs(t, err, migrate.ErrNilVersion)
+
+	expected := append([]string(nil), ups...)
+	for i := len(downs) - 1; i >= 0; i-- {
+		expected = append(expected, downs[i])
+	}
+	assert.Equal(t, expected, driver.(*stub.Stub).MigrationSequence)
+	assert.Equal(t, database.NilVersion, driver.(*stub.Stub).CurrentVersion)
+}